@@ -20,6 +20,10 @@ require_api( 'file_api.php' );
 require_api( 'database_api.php' );
 
 class JiraPlugin extends MantisPlugin {
+	// mantisbt-jira exits with this code when its queue is full,
+	// and the direct call to Jira has failed, too.
+	const EXIT_QUEUE_FULL = 100;
+
 	private $issueid_field_id = 4;
 	private $skip_reporter_id = 0;
 	private $log_file = null;
@@ -54,6 +58,10 @@ class JiraPlugin extends MantisPlugin {
 			'user' => plugin_config_get( 'user', '' ),
 			'password' => plugin_config_get( 'password', '' ),
             'key_regexp' => plugin_config_get( 'key_regexp', '^(INCIDENT|CHANGE|REQUEST|PROBLEM)-[0-9]+$' ),
+			'queue_max_items' => plugin_config_get( 'queue_max_items', 0 ),
+			'queue_max_bytes' => plugin_config_get( 'queue_max_bytes', 0 ),
+			'queue_storage' => plugin_config_get( 'queue_storage', '' ),
+			'queue_key_file' => plugin_config_get( 'queue_key_file', '' ),
 		);
 	}
 
@@ -121,15 +129,19 @@ class JiraPlugin extends MantisPlugin {
 			return;
 		}
 
+		// The same change may fire EVENT_UPDATE_BUG more than once.
+		$t_key = '--key=status-' . $p_new->id . '-' . $p_new->status . '-' . $p_new->last_updated;
 		if( $t_tran_id != 0 ) {
 			$this->call("issue", array(
 				"transition",
+				$t_key,
 				$t_issueid,
 				$t_tran_id ) 
 			);
 		} elseif ( $t_target_status_id ) {
 			$this->call("issue", array(
 				"transition", "to",
+				$t_key,
 				$t_issueid,
 				$t_target_status_id ) 
 			);
@@ -233,6 +245,7 @@ $this->log( 'note length: ' .strlen( $t_bugnote->note ) );
 			if( strlen($t_bugnote->note) !== 0 ) {
 				$this->call("comment", array( 
 					"--mantisid=" . $p_bug_id,
+					"--key=bugnote-" . $p_bugnote_id,
 					$t_issueid, $t_bugnote->note . "\n\n<<" . user_get_realname( $t_bugnote->reporter_id ) . '>>' ) );
 $this->log( 'comment added' );
 			}
@@ -256,6 +269,7 @@ $this->log( 'comment added' );
 			}
 			$this->call( "attach", array(
 				"--mantisid=" . $p_bug_id,
+				"--key=file-" . $t_file['id'],
 				"--filename=" . $t_file['name'], 
 				$t_issueid, 
 				$t_local_disk_file,
@@ -272,6 +286,18 @@ $this->log( 'comment added' );
 			}
 		}
 		$t_args[] = '--queues=/var/local/mantis/jira';
+		if( $t_conf['queue_max_items'] ) {
+			$t_args[] = '--queue-max-items=' . (int)$t_conf['queue_max_items'];
+		}
+		if( $t_conf['queue_max_bytes'] ) {
+			$t_args[] = '--queue-max-bytes=' . (int)$t_conf['queue_max_bytes'];
+		}
+		if( $t_conf['queue_storage'] ) {
+			$t_args[] = escapeshellarg( '--queue-storage=' . $t_conf['queue_storage'] );
+		}
+		if( $t_conf['queue_key_file'] ) {
+			$t_args[] = escapeshellarg( '--queue-key-file=' . $t_conf['queue_key_file'] );
+		}
 		
 		$t_output = array();
 		$t_args = implode( ' ', $t_args ) . ' ' . escapeshellarg( $p_subcommand );
@@ -294,6 +320,9 @@ $this->log( 'comment added' );
 		fclose( $t_pipes[2] );
 		$t_rc = proc_close( $t_process );
 		$this->log('got ' . $t_rc . ': stderr=' . var_export( $t_stderr, TRUE ) );
+		if( $t_rc == self::EXIT_QUEUE_FULL ) {
+			trigger_error( 'The Jira queue is full and Jira is unreachable: ' . $p_subcommand . ' has not been sent to Jira!', E_USER_WARNING );
+		}
 		return array( $t_rc, $t_stdout );
 	}
 
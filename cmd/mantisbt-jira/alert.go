@@ -0,0 +1,566 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/mantisbt-plugins-Jira/cmd/mantisbt-jira/dirq"
+)
+
+// defaultAlertSubject is the prefix of the subject of the alerts, if not given in the alert URL.
+const defaultAlertSubject = "Mantis->JIRA hiba"
+
+// An Alerter sends the alerts to the operators.
+type Alerter interface {
+	Alert(ctx context.Context, subject, body string) error
+}
+
+// alertSubject prefixes the subject with the prefix (defaultAlertSubject if empty).
+func alertSubject(prefix, subject string) string {
+	if prefix == "" {
+		prefix = defaultAlertSubject
+	}
+	if subject == "" {
+		return prefix
+	}
+	return prefix + ": " + subject
+}
+
+// newAlerter returns the Alerter sending the alerts to all the given URLs:
+//
+//   - mailto:a@example.com,b@example.com?subject=... (with sendmail; a bare email address is a mailto: URL),
+//   - smtp://[user:password@]host[:port]?from=...&to=...&to=...&subject=... (with net/smtp),
+//   - https://... (and http://): POST a JSON webhook ({"title":subject,"text":body}),
+//   - file:///path: append the alerts to the file.
+//
+// The subject parameter replaces defaultAlertSubject as the prefix of the subjects.
+//
+// Returns nil if there is no URL.
+func newAlerter(urls []string) (Alerter, error) {
+	var alerters multiAlerter
+	var mailto *sendmailAlerter
+	for _, s := range urls {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, ":") && strings.Contains(s, "@") {
+			s = "mailto:" + s
+		}
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("parse alert URL %q: %w", s, err)
+		}
+		subject := u.Query().Get("subject")
+		switch u.Scheme {
+		case "mailto":
+			// All the addresses get the same mail.
+			if mailto == nil {
+				mailto = &sendmailAlerter{Subject: subject}
+				alerters = append(alerters, mailto)
+			}
+			for _, a := range strings.Split(u.Opaque, ",") {
+				if a, err = url.PathUnescape(a); err != nil {
+					return nil, fmt.Errorf("parse alert URL %q: %w", s, err)
+				}
+				if a != "" {
+					mailto.To = append(mailto.To, a)
+				}
+			}
+		case "smtp":
+			q := u.Query()
+			sa := smtpAlerter{Addr: u.Host, From: q.Get("from"), To: q["to"], Subject: subject}
+			if len(sa.To) == 0 {
+				return nil, fmt.Errorf("alert URL %q: no recipient (to=)", s)
+			}
+			if _, _, err := net.SplitHostPort(sa.Addr); err != nil {
+				sa.Addr = net.JoinHostPort(sa.Addr, "25")
+			}
+			if sa.From == "" {
+				sa.From = defaultAlertFrom()
+			}
+			if u.User != nil {
+				password, _ := u.User.Password()
+				sa.Auth = smtp.PlainAuth("", u.User.Username(), password, u.Hostname())
+			}
+			alerters = append(alerters, sa)
+		case "http", "https":
+			alerters = append(alerters, webhookAlerter{URL: u.String(), Subject: subject})
+		case "file":
+			alerters = append(alerters, &fileAlerter{Path: u.Path, Subject: subject})
+		default:
+			return nil, fmt.Errorf("alert URL %q: unknown scheme %q", s, u.Scheme)
+		}
+	}
+	switch len(alerters) {
+	case 0:
+		return nil, nil
+	case 1:
+		return alerters[0], nil
+	default:
+		return alerters, nil
+	}
+}
+
+func defaultAlertFrom() string {
+	hostname, _ := os.Hostname()
+	return "mantisbt-jira@" + hostname
+}
+
+// multiAlerter sends the alerts to all of its Alerters.
+type multiAlerter []Alerter
+
+func (ma multiAlerter) Alert(ctx context.Context, subject, body string) error {
+	var errs []error
+	for _, a := range ma {
+		if err := a.Alert(ctx, subject, body); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// mailMessage formats the alert as a mail.
+func mailMessage(from string, to []string, subject, body string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	if len(to) != 0 {
+		fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(to, ", "))
+	}
+	fmt.Fprintf(&buf, "Subject: %s\r\nDate: %s\r\n\r\n%s", subject, time.Now().Format(time.RFC1123Z), body)
+	return buf.Bytes()
+}
+
+// sendmailAlerter sends the alerts with the local sendmail.
+type sendmailAlerter struct {
+	Subject string
+	To      []string
+}
+
+func (sa *sendmailAlerter) Alert(ctx context.Context, subject, body string) error {
+	subject = alertSubject(sa.Subject, subject)
+	cmd := exec.CommandContext(ctx, "sendmail", sa.To...)
+	cmd.Stdin = bytes.NewReader(mailMessage(defaultAlertFrom(), nil, subject, body))
+	if b, err := cmd.CombinedOutput(); err != nil {
+		logger.Error("sendmail", "args", cmd.Args, "output", string(b), "error", err)
+		return fmt.Errorf("sendmail: %w", err)
+	}
+	logger.Info("sendmail", "args", cmd.Args)
+	return nil
+}
+
+// smtpAlerter sends the alerts through an SMTP server.
+type smtpAlerter struct {
+	Auth    smtp.Auth
+	Addr    string
+	From    string
+	Subject string
+	To      []string
+}
+
+func (sa smtpAlerter) Alert(ctx context.Context, subject, body string) error {
+	subject = alertSubject(sa.Subject, subject)
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	if err := sa.sendMail(ctx, mailMessage(sa.From, sa.To, subject, body)); err != nil {
+		return fmt.Errorf("smtp %s: %w", sa.Addr, err)
+	}
+	logger.Info("smtp", "addr", sa.Addr, "to", sa.To)
+	return nil
+}
+
+// sendMail is smtp.SendMail, but bound by ctx: a hanging server
+// must not block the alerts (and the queue reporting them).
+func (sa smtpAlerter) sendMail(ctx context.Context, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", sa.Addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err = conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	host, _, _ := net.SplitHostPort(sa.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if sa.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("server does not support AUTH")
+		}
+		if err = c.Auth(sa.Auth); err != nil {
+			return err
+		}
+	}
+	if err = c.Mail(sa.From); err != nil {
+		return err
+	}
+	for _, to := range sa.To {
+		if err = c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// webhookAlerter posts the alerts as JSON to a webhook (Teams, Mattermost, Slack style).
+type webhookAlerter struct {
+	URL     string
+	Subject string
+}
+
+func (wa webhookAlerter) Alert(ctx context.Context, subject, body string) error {
+	subject = alertSubject(wa.Subject, subject)
+	b, err := json.Marshal(struct {
+		Title string `json:"title"`
+		Text  string `json:"text"`
+	}{Title: subject, Text: subject + "\n\n" + body})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", wa.URL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("webhook %s: %w", redactedURL(req.URL), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook %s: %s: %s", redactedURL(req.URL), resp.Status, msg)
+	}
+	logger.Info("webhook", "url", redactedURL(req.URL), "status", resp.Status)
+	return nil
+}
+
+// fileAlerter appends the alerts to a file (for testing).
+type fileAlerter struct {
+	Path    string
+	Subject string
+	mu      sync.Mutex
+}
+
+func (fa *fileAlerter) Alert(ctx context.Context, subject, body string) error {
+	subject = alertSubject(fa.Subject, subject)
+	fa.mu.Lock()
+	defer fa.mu.Unlock()
+	fh, err := os.OpenFile(fa.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fh, "--- %s %s\n%s\n", time.Now().Format(time.RFC3339), subject, body)
+	if closeErr := fh.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// alertClass is the fingerprint of an alert: the class of its error.
+type alertClass string
+
+const (
+	alertAuth        = alertClass("auth failure")
+	alertServer      = alertClass("Jira server error")
+	alertNotFound    = alertClass("issue not found")
+	alertPermission  = alertClass("permission denied")
+	alertClientError = alertClass("Jira request error")
+	alertDeadLetter  = alertClass("dead-lettered")
+	alertQuarantine  = alertClass("quarantined")
+	alertOther       = alertClass("other error")
+)
+
+// classifyAlert returns the class of the error.
+func classifyAlert(err error) alertClass {
+	if qErr := (*dirq.QuarantineError)(nil); errors.As(err, &qErr) {
+		return alertQuarantine
+	} else if dlErr := (*dirq.DeadLetterError)(nil); errors.As(err, &dlErr) {
+		return alertDeadLetter
+	}
+	if errors.Is(err, errAuthenticate) {
+		return alertAuth
+	}
+	if isIssueNotExist(err) {
+		return alertNotFound
+	}
+	var je *JIRAError
+	if !errors.As(err, &je) {
+		return alertOther
+	}
+	switch code := je.StatusCode(); {
+	case code == http.StatusUnauthorized:
+		return alertAuth
+	case code == http.StatusForbidden:
+		return alertPermission
+	case code == http.StatusNotFound:
+		return alertNotFound
+	case code >= 500:
+		return alertServer
+	case code >= 400:
+		if strings.Contains(strings.ToLower(je.Error()), "permission") {
+			return alertPermission
+		}
+		return alertClientError
+	}
+	return alertOther
+}
+
+// issueSpecific reports whether the class is about an issue (or its item),
+// not about the queue (Jira) as a whole: the success of another issue
+// does not recover it.
+func (c alertClass) issueSpecific() bool {
+	switch c {
+	case alertNotFound, alertPermission, alertClientError, alertDeadLetter, alertQuarantine:
+		return true
+	}
+	return false
+}
+
+// alertKey identifies the alerts of a class of a queue.
+type alertKey struct {
+	Queue string
+	Class alertClass
+}
+
+// alertState is the state of an active alertKey.
+type alertState struct {
+	// First and Last are the time of the first and last occurrence,
+	// Notified is the time of the last notification.
+	First, Last, Notified time.Time
+	// Sample is the first error.
+	Sample string
+	// IDs are sample issue (or item) IDs.
+	IDs []string
+	// Count is the number of the occurrences since the last notification,
+	// Total is the number of all the occurrences.
+	Count, Total int
+	// Level is the escalation level: the number of the notifications
+	// about the persisting class.
+	Level int
+	// Recovered is the time of the first success of the queue since the last occurrence.
+	Recovered time.Time
+	// Failing are the issues of an issue-specific class (see issueSpecific)
+	// with an occurrence since their last success.
+	Failing map[string]struct{}
+}
+
+const (
+	// maxAlertIDs is the number of the sample IDs kept per alert class.
+	maxAlertIDs = 5
+
+	// DefaultAlertEscalateAfter is the time after which a persisting alert class
+	// is notified again (escalated), doubled on each escalation,
+	// up to DefaultAlertMaxEscalateAfter.
+	DefaultAlertEscalateAfter    = 30 * time.Minute
+	DefaultAlertMaxEscalateAfter = 24 * time.Hour
+)
+
+// alertNotifier fingerprints the errors by class (see classifyAlert),
+// and sends the alerts through the Alerter:
+// a notice when a class appears, escalations while it persists,
+// and a recovery notice when the queue succeeds again (see Succeeded).
+//
+// A quiet class is not recovered: the queue may just wait with its retries.
+type alertNotifier struct {
+	Alerter Alerter
+	active  map[alertKey]*alertState
+
+	EscalateAfter, MaxEscalateAfter time.Duration
+
+	mu sync.Mutex
+}
+
+func newAlertNotifier(alerter Alerter) *alertNotifier {
+	return &alertNotifier{
+		Alerter:       alerter,
+		active:        make(map[alertKey]*alertState),
+		EscalateAfter: DefaultAlertEscalateAfter, MaxEscalateAfter: DefaultAlertMaxEscalateAfter,
+	}
+}
+
+// Record the error of the queue, with the ID of the issue (or item) it occurred with.
+//
+// A new class is notified immediately.
+func (an *alertNotifier) Record(ctx context.Context, queue string, err error, id string) error {
+	if err == nil {
+		return nil
+	}
+	now := time.Now()
+	k := alertKey{Queue: queue, Class: classifyAlert(err)}
+	an.mu.Lock()
+	st := an.active[k]
+	isNew := st == nil
+	if isNew {
+		st = &alertState{First: now, Sample: err.Error(), Failing: make(map[string]struct{})}
+		an.active[k] = st
+	}
+	st.Last, st.Recovered = now, time.Time{}
+	if id != "" && k.Class.issueSpecific() {
+		st.Failing[id] = struct{}{}
+	}
+	st.Count++
+	st.Total++
+	if id != "" && len(st.IDs) < maxAlertIDs && !slices.Contains(st.IDs, id) {
+		st.IDs = append(st.IDs, id)
+	}
+	an.mu.Unlock()
+	logger.Debug("alert", "queue", queue, "class", k.Class, "new", isNew)
+	if isNew {
+		return an.Flush(ctx)
+	}
+	return nil
+}
+
+// Succeeded records a success of the issue (group) of the queue, notified with the next Flush:
+// the classes of the queue as a whole are recovered, and the issue-specific classes
+// when none of their issues are failing any more.
+func (an *alertNotifier) Succeeded(queue, issueID string) {
+	now := time.Now()
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	for k, st := range an.active {
+		if k.Queue != queue || !st.Recovered.IsZero() {
+			continue
+		}
+		if k.Class.issueSpecific() && len(st.Failing) != 0 {
+			delete(st.Failing, issueID)
+			if len(st.Failing) != 0 {
+				continue
+			}
+		}
+		st.Recovered = now
+	}
+}
+
+// Flush sends the due notifications.
+func (an *alertNotifier) Flush(ctx context.Context) error {
+	subject, body := an.report(time.Now())
+	if body == "" {
+		return nil
+	}
+	if err := an.Alerter.Alert(ctx, subject, body); err != nil {
+		promAlerts.Inc("failed")
+		logger.Error("send alert", "subject", subject, "error", err)
+		return err
+	}
+	promAlerts.Inc("sent")
+	return nil
+}
+
+// Run flushes the notifications every minute, till ctx is done.
+func (an *alertNotifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = an.Flush(ctx)
+		}
+	}
+}
+
+// report returns the subject and the body of the notifications due at now,
+// and marks them as notified.
+// The body is empty if there is nothing to notify.
+func (an *alertNotifier) report(now time.Time) (subject, body string) {
+	var buf strings.Builder
+	var summary []string
+	an.mu.Lock()
+	defer an.mu.Unlock()
+	keys := slices.SortedFunc(maps.Keys(an.active), func(a, b alertKey) int {
+		return cmp.Or(cmp.Compare(a.Queue, b.Queue), cmp.Compare(a.Class, b.Class))
+	})
+	for _, k := range keys {
+		st := an.active[k]
+		var what string
+		switch {
+		case !st.Recovered.IsZero():
+			delete(an.active, k)
+			summary = append(summary, fmt.Sprintf("%s recovered", k.Class))
+			fmt.Fprintf(&buf, "RECOVERED %s in %s: succeeded at %s, no occurrence since %s (%d in total since %s).\n\n",
+				k.Class, k.Queue, st.Recovered.Format(time.DateTime), st.Last.Format(time.DateTime), st.Total, st.First.Format(time.DateTime))
+			continue
+		case st.Count == 0:
+			// Quiet, but not recovered yet.
+			continue
+		case st.Notified.IsZero():
+			what = "NEW"
+			summary = append(summary, string(k.Class))
+		default:
+			// Doubled on each escalation - without overflowing.
+			after := an.EscalateAfter
+			for i := 0; i < st.Level && after < an.MaxEscalateAfter; i++ {
+				after *= 2
+			}
+			if now.Sub(st.Notified) < min(after, an.MaxEscalateAfter) {
+				continue
+			}
+			st.Level++
+			what = fmt.Sprintf("ESCALATED (level %d)", st.Level)
+			summary = append(summary, fmt.Sprintf("%s persists", k.Class))
+		}
+		if st.Notified.IsZero() {
+			fmt.Fprintf(&buf, "%s %s in %s: %d times since %s",
+				what, k.Class, k.Queue, st.Count, st.First.Format(time.DateTime))
+		} else {
+			fmt.Fprintf(&buf, "%s %s in %s: %d times since %s (%d in total since %s)",
+				what, k.Class, k.Queue, st.Count, st.Notified.Format(time.DateTime), st.Total, st.First.Format(time.DateTime))
+		}
+		if len(st.IDs) != 0 {
+			fmt.Fprintf(&buf, ", e.g. %s", strings.Join(st.IDs, ", "))
+		}
+		fmt.Fprintf(&buf, "\n\t%s\n\n", st.Sample)
+		st.Notified, st.Count, st.IDs = now, 0, st.IDs[:0]
+	}
+	if len(summary) == 0 {
+		return "", ""
+	}
+	return strings.Join(summary, "; "), buf.String()
+}
@@ -0,0 +1,72 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"errors"
+	"log/slog"
+	"path"
+	"time"
+)
+
+// DoneDir is the name of the archive subdirectory of the queue,
+// partitioned by the date of the processing (done/YYYY-MM-DD).
+const DoneDir = "done"
+
+const doneDateFormat = "2006-01-02"
+
+// archive moves the processed item (nmy) into the archive, with its metadata and result.
+func (Q *Queue) archive(nmy string, it item, result []byte) error {
+	now := time.Now()
+	dir := path.Join(DoneDir, now.Format(doneDateFormat))
+	if err := Q.st.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	m := it.Meta
+	m.Done, m.Result, m.NextAttempt = now, result, time.Time{}
+	if err := Q.writeMeta(dir, it.Name, m); err != nil {
+		return err
+	}
+	if err := Q.st.Rename(nmy, path.Join(dir, it.Name)); err != nil {
+		_ = Q.removeFile(path.Join(dir, metaName(it.Name)))
+		return err
+	}
+	return nil
+}
+
+// PruneDone removes the archived items older than maxAge.
+func (Q *Queue) PruneDone(maxAge time.Duration) error {
+	dis, err := Q.readDir(DoneDir)
+	if len(dis) == 0 {
+		return err
+	}
+	limit := time.Now().Add(-maxAge)
+	var errs []error
+	for _, di := range dis {
+		day, err := time.ParseInLocation(doneDateFormat, di.Name(), time.Local)
+		if !di.IsDir() || err != nil {
+			continue
+		}
+		// The whole day must be older than the limit.
+		if !day.AddDate(0, 0, 1).Before(limit) {
+			continue
+		}
+		slog.Info("PruneDone remove", "dir", di.Name())
+		if err := Q.st.RemoveAll(path.Join(DoneDir, di.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// doneDirs returns the date partitions of the archive.
+func (Q *Queue) doneDirs() []string {
+	dis, _ := Q.st.ReadDir(DoneDir)
+	dirs := make([]string, 0, len(dis))
+	for _, di := range dis {
+		if di.IsDir() {
+			dirs = append(dirs, path.Join(DoneDir, di.Name()))
+		}
+	}
+	return dirs
+}
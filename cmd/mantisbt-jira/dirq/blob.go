@@ -0,0 +1,271 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/oklog/ulid/v2"
+)
+
+// BlobDir is the name of the content-addressed blob subdirectory of the queue.
+const BlobDir = "blobs"
+
+// WithBlobs records the blobs referenced by the message,
+// to keep them till the message is in the queue (or in the dead-letter directory, or in the archive).
+func WithBlobs(hashes ...string) Option {
+	return func(m *Meta) { m.Blobs = append(m.Blobs, hashes...) }
+}
+
+// PutBlob stores the contents of r in the blob area,
+// and returns its hash: the SHA-256 of the contents,
+// or their keyed hash (HMAC-SHA256) with the current key iff Keys is set.
+//
+// The blob must be referenced by an enqueued message (see WithBlobs),
+// otherwise it will be garbage collected.
+//
+// Returns ErrFull if the blob does not fit in MaxBytes.
+func (Q *Queue) PutBlob(r io.Reader) (string, error) {
+	r, err := Q.quotaReader(r)
+	if err != nil {
+		return "", err
+	}
+	if err := Q.st.MkdirAll(BlobDir, 0750); err != nil {
+		return "", err
+	}
+	tmp := path.Join(BlobDir, ".tmp-"+ulid.Make().String())
+	h := sha256.New()
+	if Q.Keys != nil {
+		h = Q.Keys.newNameHash()
+	}
+	if err = Q.writeBlob(tmp, io.TeeReader(r, h)); err != nil {
+		return "", fmt.Errorf("write blob: %w", err)
+	}
+	defer func() { _ = Q.removeFile(tmp) }()
+	hsh := hex.EncodeToString(h.Sum(nil))
+	if err = Q.st.Rename(tmp, path.Join(BlobDir, hsh)); err != nil {
+		return "", err
+	}
+	slog.Debug("PutBlob", "hash", hsh)
+	return hsh, nil
+}
+
+// writeBlob writes the contents of r into the blob file name,
+// compressed (iff it is larger than CompressThreshold) and encrypted (iff Keys is set).
+//
+// The (decrypted) blob starts with the version 1 item header, without a checksum,
+// as the hash of the blob verifies its contents.
+func (Q *Queue) writeBlob(name string, r io.Reader) error {
+	codec, br := CodecNone, bufio.NewReaderSize(r, max(Q.CompressThreshold+1, 4096))
+	if Q.CompressThreshold > 0 {
+		if _, err := br.Peek(Q.CompressThreshold + 1); err == nil {
+			codec = CodecZstd
+		}
+	}
+	var body io.Reader = br
+	if codec == CodecZstd {
+		pr, pw := io.Pipe()
+		// Stop the compressor if the write fails.
+		defer pr.Close()
+		go func() {
+			zw, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+			if err == nil {
+				_, err = io.Copy(zw, br)
+				if closeErr := zw.Close(); err == nil {
+					err = closeErr
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+		body = pr
+	}
+	r = io.MultiReader(bytes.NewReader(append([]byte(magic), 1, byte(codec))), body)
+	if Q.Keys != nil {
+		r = Q.Keys.newSealReader(r)
+	}
+	return Q.st.WriteFile(name, r, 0400)
+}
+
+// OpenBlob opens the blob for reading (decrypting and decompressing it if needed).
+//
+// Reading a blob whose contents do not match its hash returns ErrCorrupt at the end.
+func (Q *Queue) OpenBlob(hash string) (fs.File, error) {
+	if !isBlobName(hash) {
+		return nil, fmt.Errorf("%q: %w", hash, ErrBadBlob)
+	}
+	fh, err := Q.st.Open(path.Join(BlobDir, hash))
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+	bf := &blobFile{File: fh, fi: fileInfo{
+		name: fi.Name(), size: fi.Size(), mode: fi.Mode(), modTime: fi.ModTime(),
+	}}
+	hdr := make([]byte, blobHeaderLen)
+	n, _ := io.ReadFull(fh, hdr)
+	r := io.MultiReader(bytes.NewReader(hdr[:n]), fh)
+	if n == len(hdr) && bytes.HasPrefix(hdr, []byte(blobMagic)) {
+		if r, err = Q.Keys.newOpenReader(r); err != nil {
+			fh.Close()
+			return nil, fmt.Errorf("%s: %w", hash, err)
+		}
+		bf.fi.size = plainBlobSize(bf.fi.size)
+	}
+	// Blobs written by the earlier versions have no header.
+	br := bufio.NewReader(r)
+	if b, _ := br.Peek(v1HeaderLen); len(b) == v1HeaderLen && bytes.HasPrefix(b, []byte(magic)) && b[len(magic)] == 1 {
+		_, _ = br.Discard(v1HeaderLen)
+		bf.fi.size -= int64(v1HeaderLen)
+		switch codec := Codec(b[len(magic)+1]); codec {
+		case CodecNone:
+		case CodecZstd:
+			zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				fh.Close()
+				return nil, fmt.Errorf("%s: %w", hash, err)
+			}
+			bf.closer = zr.Close
+			bf.r = newVerifyReader(zr, hash, Q.Keys)
+			// The size of the decompressed blob is known only after reading it.
+			bf.plainSize = func() (int64, error) {
+				fh, err := Q.OpenBlob(hash)
+				if err != nil {
+					return 0, err
+				}
+				defer fh.Close()
+				return io.Copy(io.Discard, fh)
+			}
+			return bf, nil
+		default:
+			fh.Close()
+			return nil, fmt.Errorf("%s: %w: unknown codec %s", hash, ErrCorrupt, codec)
+		}
+	}
+	bf.r = newVerifyReader(br, hash, Q.Keys)
+	return bf, nil
+}
+
+// verifyReader checks the hash of the read contents at EOF.
+type verifyReader struct {
+	r    io.Reader
+	hs   []hash.Hash
+	want string
+}
+
+// newVerifyReader returns a reader checking the plain hash of the contents,
+// and their keyed hashes with all the keys of kr.
+func newVerifyReader(r io.Reader, want string, kr *Keyring) *verifyReader {
+	hs := append([]hash.Hash{sha256.New()}, kr.nameHashes()...)
+	ws := make([]io.Writer, len(hs))
+	for i, h := range hs {
+		ws[i] = h
+	}
+	return &verifyReader{r: io.TeeReader(r, io.MultiWriter(ws...)), hs: hs, want: want}
+}
+
+// Read returns ErrCorrupt instead of io.EOF if none of the hashes of the contents
+// matches the name of the blob.
+func (vr *verifyReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	if err == io.EOF {
+		for _, h := range vr.hs {
+			if hex.EncodeToString(h.Sum(nil)) == vr.want {
+				return n, err
+			}
+		}
+		return n, fmt.Errorf("%w: blob %s has hash %s", ErrCorrupt, vr.want, hex.EncodeToString(vr.hs[0].Sum(nil)))
+	}
+	return n, err
+}
+
+// ErrBadBlob is returned for a malformed blob hash.
+var ErrBadBlob = errors.New("bad blob hash")
+
+func isBlobName(s string) bool {
+	if len(s) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// GCBlobs removes the blobs which are not referenced by any message,
+// in the queue, in the dead-letter or quarantine directory or in the archive.
+//
+// Blobs younger than grace are kept, as they may be just being enqueued.
+func (Q *Queue) GCBlobs(grace time.Duration) error {
+	dis, err := Q.readDir(BlobDir)
+	if len(dis) == 0 {
+		return err
+	}
+	refs := make(map[string]struct{})
+	for _, dir := range append([]string{".", DeadDir, QuarantineDir}, Q.doneDirs()...) {
+		if err := Q.readBlobRefs(refs, dir); err != nil {
+			return err
+		}
+	}
+	var errs []error
+	for _, di := range dis {
+		nm := di.Name()
+		if _, ok := refs[nm]; ok {
+			continue
+		}
+		fi, err := di.Info()
+		if err != nil || time.Since(fi.ModTime()) < grace {
+			continue
+		}
+		if !isBlobName(nm) && !strings.HasPrefix(nm, ".tmp-") {
+			continue
+		}
+		slog.Info("GCBlobs remove", "blob", nm)
+		if err := Q.removeFile(path.Join(BlobDir, nm)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readBlobRefs collects the blobs referenced by the metadata in dir.
+func (Q *Queue) readBlobRefs(refs map[string]struct{}, dir string) error {
+	dis, err := Q.readDir(dir)
+	if len(dis) == 0 {
+		return err
+	}
+	for _, di := range dis {
+		if !strings.HasSuffix(di.Name(), metaExt) {
+			continue
+		}
+		b, err := Q.st.ReadFile(path.Join(dir, di.Name()))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		m, err := Q.decodeMeta(b)
+		if err != nil {
+			return fmt.Errorf("%s: %w", di.Name(), err)
+		}
+		for _, h := range m.Blobs {
+			refs[h] = struct{}{}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The item file starts with a header:
+//
+//	"DIRQ" version codec crc32c(4)
+//
+// followed by the (possibly compressed) payload, whose checksum is in the header.
+// Version 1 headers have no checksum,
+// files without the header (written by the earlier versions) are raw payloads.
+// Blobs start with a version 1 header, as their hash verifies them.
+const (
+	magic         = "DIRQ"
+	formatVersion = 2
+	v1HeaderLen   = len(magic) + 2
+	headerLen     = v1HeaderLen + 4
+)
+
+// ErrCorrupt is returned for an item (or blob) which does not match its checksum,
+// or cannot be decoded. Dequeue moves such items to the quarantine directory.
+var ErrCorrupt = errors.New("corrupt data")
+
+// Codec is the compression method of the payload.
+type Codec byte
+
+const (
+	CodecNone = Codec(0)
+	CodecZstd = Codec(1)
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("codec(%d)", byte(c))
+	}
+}
+
+// DefaultCompressThreshold is the default size above which items are compressed.
+const DefaultCompressThreshold = 4 << 10
+
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+func zstdInit() {
+	var err error
+	if zstdEnc, err = zstd.NewWriter(nil); err != nil {
+		panic(err)
+	}
+	if zstdDec, err = zstd.NewReader(nil); err != nil {
+		panic(err)
+	}
+}
+
+// encode the payload into the item file format,
+// compressing it iff it is larger than threshold (if threshold is positive).
+func encode(p []byte, threshold int) []byte {
+	codec := CodecNone
+	if threshold > 0 && len(p) > threshold {
+		codec = CodecZstd
+	}
+	b := make([]byte, headerLen, headerLen+len(p))
+	copy(b, magic)
+	b[len(magic)], b[len(magic)+1] = formatVersion, byte(codec)
+	if codec == CodecNone {
+		b = append(b, p...)
+	} else {
+		zstdOnce.Do(zstdInit)
+		b = zstdEnc.EncodeAll(p, b)
+	}
+	binary.BigEndian.PutUint32(b[v1HeaderLen:], crc32.Checksum(b[headerLen:], crcTable))
+	return b
+}
+
+// decode the (possibly encrypted) item file contents, returning the payload.
+func (Q *Queue) decode(b []byte) ([]byte, error) {
+	if IsSealed(b) {
+		var err error
+		if b, err = Q.Keys.Open(b); err != nil {
+			return nil, err
+		}
+	}
+	return decode(b)
+}
+
+// decode the item file contents, returning the payload.
+func decode(b []byte) ([]byte, error) {
+	if len(b) < v1HeaderLen || !bytes.HasPrefix(b, []byte(magic)) {
+		return b, nil
+	}
+	hl := v1HeaderLen
+	switch v := b[len(magic)]; v {
+	case 1:
+	case formatVersion:
+		if len(b) < headerLen {
+			return nil, fmt.Errorf("%w: short header", ErrCorrupt)
+		}
+		hl = headerLen
+		if want, got := binary.BigEndian.Uint32(b[v1HeaderLen:]), crc32.Checksum(b[hl:], crcTable); got != want {
+			return nil, fmt.Errorf("%w: checksum mismatch (got %08x, wanted %08x)", ErrCorrupt, got, want)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown format version %d", ErrCorrupt, v)
+	}
+	switch codec := Codec(b[len(magic)+1]); codec {
+	case CodecNone:
+		return b[hl:], nil
+	case CodecZstd:
+		zstdOnce.Do(zstdInit)
+		p, err := zstdDec.DecodeAll(b[hl:], nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: decompress %s: %w", ErrCorrupt, codec, err)
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown codec %s", ErrCorrupt, codec)
+	}
+}
@@ -0,0 +1,489 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// An encrypted item (or any sealed data, see Keyring.Seal) is
+//
+//	"DIRE" version keyID(4) nonce(12) AES-256-GCM(data)
+//
+// where data is the encoded item (with its own header).
+//
+// An encrypted blob is
+//
+//	"DIRB" version keyID(4) noncePrefix(7) chunk...
+//
+// where each chunk is the AES-256-GCM sealed blobChunkSize bytes of the blob
+// (less for the last one), with the nonce noncePrefix counter(4) last(1).
+//
+// The header is the additional data of each seal.
+const (
+	sealMagic     = "DIRE"
+	blobMagic     = "DIRB"
+	sealVersion   = 1
+	keyIDLen      = 4
+	sealHeaderLen = len(sealMagic) + 1 + keyIDLen + 12
+	blobHeaderLen = len(blobMagic) + 1 + keyIDLen + 7
+	blobChunkSize = 64 << 10
+	gcmTagLen     = 16
+)
+
+// ErrNoKey is returned when the data is encrypted with a key not in the keyring
+// (or there is no keyring at all).
+//
+// This is a configuration error, not the fault of the item, thus it is ErrTransient:
+// the item is not dead-lettered, but skipped (with its group) by Dequeue until the key is added.
+var ErrNoKey = fmt.Errorf("%w: no key to decrypt", ErrTransient)
+
+// Keyring holds the AES-256 keys for encryption at rest.
+//
+// The first key encrypts, all the keys decrypt - to rotate the key,
+// put the new key first, and drop the old one after Rekey.
+//
+// The names derived from the contents (the idempotency key marks and the blobs)
+// are keyed hashes (HMAC-SHA256), too - so drop the old key only after the
+// KeyRetention, and after the items referencing the blobs written with it are gone.
+type Keyring struct {
+	aeads map[[keyIDLen]byte]cipher.AEAD
+	// macKeys are the keys of the name hashes, by key ID.
+	macKeys map[[keyIDLen]byte][]byte
+	ids     [][keyIDLen]byte
+}
+
+// ParseKeys parses the whitespace- or comma-separated list of
+// base64-encoded 32-byte keys. Lines starting with # are comments.
+func ParseKeys(s string) (*Keyring, error) {
+	kr := Keyring{aeads: make(map[[keyIDLen]byte]cipher.AEAD), macKeys: make(map[[keyIDLen]byte][]byte)}
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, f := range strings.FieldsFunc(line, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			key, err := base64.StdEncoding.DecodeString(f)
+			if err != nil {
+				return nil, fmt.Errorf("parse key: %w", err)
+			}
+			if err = kr.add(key); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(kr.ids) == 0 {
+		return nil, errors.New("no key")
+	}
+	return &kr, nil
+}
+
+// ReadKeyFile reads the keys from the file (see ParseKeys).
+func ReadKeyFile(fn string) (*Keyring, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	kr, err := ParseKeys(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return kr, nil
+}
+
+// NewKey returns a new random key, base64-encoded.
+func NewKey() string {
+	var key [32]byte
+	_, _ = rand.Read(key[:])
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+func (kr *Keyring) add(key []byte) error {
+	if len(key) != 32 {
+		return fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	var id [keyIDLen]byte
+	hsh := sha256.Sum256(key)
+	copy(id[:], hsh[:])
+	if _, ok := kr.aeads[id]; ok {
+		return fmt.Errorf("duplicate key %x", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if kr.aeads[id], err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("dirq names"))
+	kr.macKeys[id] = mac.Sum(nil)
+	kr.ids = append(kr.ids, id)
+	return nil
+}
+
+// newNameHash returns the keyed hash of the names with the current key.
+func (kr *Keyring) newNameHash() hash.Hash { return hmac.New(sha256.New, kr.macKeys[kr.ids[0]]) }
+
+// nameHashes returns the keyed hashes of the names with all the keys,
+// the current one first (none for a nil Keyring).
+func (kr *Keyring) nameHashes() []hash.Hash {
+	if kr == nil {
+		return nil
+	}
+	hs := make([]hash.Hash, 0, len(kr.ids))
+	for _, id := range kr.ids {
+		hs = append(hs, hmac.New(sha256.New, kr.macKeys[id]))
+	}
+	return hs
+}
+
+// KeyID returns the ID of the current (encrypting) key.
+func (kr *Keyring) KeyID() string { return hex.EncodeToString(kr.ids[0][:]) }
+
+func (kr *Keyring) aead(id []byte) (cipher.AEAD, error) {
+	if kr != nil {
+		if aead, ok := kr.aeads[[keyIDLen]byte(id)]; ok {
+			return aead, nil
+		}
+	}
+	return nil, fmt.Errorf("key %x: %w", id, ErrNoKey)
+}
+
+// IsSealed reports whether b has been sealed (see Seal).
+func IsSealed(b []byte) bool { return len(b) >= sealHeaderLen && bytes.HasPrefix(b, []byte(sealMagic)) }
+
+// Seal encrypts b with the current key.
+func (kr *Keyring) Seal(b []byte) []byte {
+	hdr := make([]byte, sealHeaderLen, sealHeaderLen+len(b)+gcmTagLen)
+	copy(hdr, sealMagic)
+	hdr[len(sealMagic)] = sealVersion
+	copy(hdr[len(sealMagic)+1:], kr.ids[0][:])
+	_, _ = rand.Read(hdr[sealHeaderLen-12:])
+	return kr.aeads[kr.ids[0]].Seal(hdr, hdr[sealHeaderLen-12:], b, hdr)
+}
+
+// Open decrypts the sealed b (see Seal).
+func (kr *Keyring) Open(b []byte) ([]byte, error) {
+	if !IsSealed(b) {
+		return nil, errors.New("not sealed")
+	}
+	if v := b[len(sealMagic)]; v != sealVersion {
+		return nil, fmt.Errorf("%w: unknown seal version %d", ErrCorrupt, v)
+	}
+	aead, err := kr.aead(b[len(sealMagic)+1 : len(sealMagic)+1+keyIDLen])
+	if err != nil {
+		return nil, err
+	}
+	hdr := b[:sealHeaderLen]
+	p, err := aead.Open(nil, hdr[sealHeaderLen-12:], b[sealHeaderLen:], hdr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypt: %w", ErrCorrupt, err)
+	}
+	return p, nil
+}
+
+// SealedWithCurrent reports whether b has been sealed with the current key (see Seal).
+func (kr *Keyring) SealedWithCurrent(b []byte) bool { return kr.sealedWith(b, sealMagic) }
+
+// sealedWith reports whether b has been sealed with the current key.
+func (kr *Keyring) sealedWith(b []byte, magic string) bool {
+	return len(b) >= len(magic)+1+keyIDLen && bytes.HasPrefix(b, []byte(magic)) &&
+		bytes.Equal(b[len(magic)+1:len(magic)+1+keyIDLen], kr.ids[0][:])
+}
+
+// sealReader encrypts the blob read from r.
+type sealReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	hdr   []byte
+	buf   []byte
+	out   []byte
+	nonce [12]byte
+	n     uint32
+	eof   bool
+}
+
+func (kr *Keyring) newSealReader(r io.Reader) *sealReader {
+	hdr := make([]byte, blobHeaderLen)
+	copy(hdr, blobMagic)
+	hdr[len(blobMagic)] = sealVersion
+	copy(hdr[len(blobMagic)+1:], kr.ids[0][:])
+	_, _ = rand.Read(hdr[blobHeaderLen-7:])
+	sr := &sealReader{
+		r: bufio.NewReader(r), aead: kr.aeads[kr.ids[0]], hdr: hdr,
+		buf: make([]byte, blobChunkSize+gcmTagLen),
+	}
+	copy(sr.nonce[:], hdr[blobHeaderLen-7:])
+	sr.out = append([]byte(nil), hdr...)
+	return sr
+}
+
+func (sr *sealReader) Read(p []byte) (int, error) {
+	for len(sr.out) == 0 {
+		if sr.eof {
+			return 0, io.EOF
+		}
+		n, last, err := readChunk(sr.r, sr.buf[:blobChunkSize])
+		if err != nil {
+			return 0, err
+		}
+		sr.eof = last
+		sr.out = sr.aead.Seal(sr.buf[:0], chunkNonce(&sr.nonce, &sr.n, last), sr.buf[:n], sr.hdr)
+	}
+	n := copy(p, sr.out)
+	sr.out = sr.out[n:]
+	return n, nil
+}
+
+// readChunk fills buf from r, reporting whether r has no more data.
+func readChunk(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, true, nil
+		}
+		return n, false, err
+	}
+	if _, err = r.Peek(1); err != nil {
+		if errors.Is(err, io.EOF) {
+			return n, true, nil
+		}
+		return n, false, err
+	}
+	return n, false, nil
+}
+
+// chunkNonce sets the counter and the last flag of the nonce, and increments the counter.
+func chunkNonce(nonce *[12]byte, n *uint32, last bool) []byte {
+	binary.BigEndian.PutUint32(nonce[7:11], *n)
+	nonce[11] = 0
+	if last {
+		nonce[11] = 1
+	}
+	*n++
+	return nonce[:]
+}
+
+// openReader decrypts the blob read from r.
+type openReader struct {
+	r     *bufio.Reader
+	aead  cipher.AEAD
+	hdr   []byte
+	buf   []byte
+	out   []byte
+	nonce [12]byte
+	n     uint32
+	eof   bool
+}
+
+func (kr *Keyring) newOpenReader(r io.Reader) (*openReader, error) {
+	hdr := make([]byte, blobHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil || !bytes.HasPrefix(hdr, []byte(blobMagic)) {
+		return nil, fmt.Errorf("%w: not an encrypted blob", ErrCorrupt)
+	}
+	if v := hdr[len(blobMagic)]; v != sealVersion {
+		return nil, fmt.Errorf("%w: unknown seal version %d", ErrCorrupt, v)
+	}
+	aead, err := kr.aead(hdr[len(blobMagic)+1 : len(blobMagic)+1+keyIDLen])
+	if err != nil {
+		return nil, err
+	}
+	or := &openReader{
+		r: bufio.NewReader(r), aead: aead, hdr: hdr,
+		buf: make([]byte, blobChunkSize+gcmTagLen),
+	}
+	copy(or.nonce[:], hdr[blobHeaderLen-7:])
+	return or, nil
+}
+
+func (or *openReader) Read(p []byte) (int, error) {
+	for len(or.out) == 0 {
+		if or.eof {
+			return 0, io.EOF
+		}
+		n, last, err := readChunk(or.r, or.buf)
+		if err != nil {
+			return 0, err
+		}
+		or.eof = last
+		if or.out, err = or.aead.Open(or.buf[:0], chunkNonce(&or.nonce, &or.n, last), or.buf[:n], or.hdr); err != nil {
+			return 0, fmt.Errorf("%w: decrypt blob chunk %d: %w", ErrCorrupt, or.n-1, err)
+		}
+	}
+	n := copy(p, or.out)
+	or.out = or.out[n:]
+	return n, nil
+}
+
+// blobFile is the (decrypting, decompressing) verifying fs.File of a blob.
+type blobFile struct {
+	fs.File
+	r      io.Reader
+	closer func()
+	// plainSize returns the size of the compressed blob, when it is first needed.
+	plainSize func() (int64, error)
+	fi        fileInfo
+}
+
+func (bf *blobFile) Read(p []byte) (int, error) { return bf.r.Read(p) }
+
+func (bf *blobFile) Stat() (fs.FileInfo, error) {
+	if bf.plainSize != nil {
+		n, err := bf.plainSize()
+		if err != nil {
+			return nil, err
+		}
+		bf.fi.size, bf.plainSize = n, nil
+	}
+	return bf.fi, nil
+}
+
+func (bf *blobFile) Close() error {
+	if bf.closer != nil {
+		bf.closer()
+	}
+	return bf.File.Close()
+}
+
+// plainBlobSize returns the size of the blob encrypted into size bytes.
+func plainBlobSize(size int64) int64 {
+	size -= int64(blobHeaderLen)
+	chunks := (size + blobChunkSize + gcmTagLen - 1) / (blobChunkSize + gcmTagLen)
+	return max(0, size-chunks*gcmTagLen)
+}
+
+// Rekey re-encrypts the items and their metadata (pending, dead, quarantined and archived)
+// and the blobs not encrypted with the current key of Keys (or not encrypted at all),
+// returning the number of the rewritten files.
+//
+// The in-flight items are skipped - run Rekey again before dropping an old key.
+// The names of the blobs and the idempotency key marks are not changed,
+// so those written with an old key are verified and found only while it is in Keys.
+func (Q *Queue) Rekey() (int, error) {
+	if Q.Keys == nil {
+		return 0, fmt.Errorf("rekey: %w", ErrNoKey)
+	}
+	var n int
+	var errs []error
+	count := func(ok bool, err error) {
+		if ok {
+			n++
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	dis, err := Q.st.ReadDir(".")
+	if err != nil {
+		return 0, err
+	}
+	for _, di := range dis {
+		nm := di.Name()
+		if !(len(nm) == 26+len(ext) && strings.HasSuffix(nm, ext)) {
+			continue
+		}
+		if Q.sealedWithCurrent(nm) && Q.sealedWithCurrent(metaName(nm)) {
+			continue
+		}
+		// Claim the pending item, to not to overwrite it under a consumer.
+		if err := Q.claim(nm); err != nil {
+			if !errors.Is(err, errClaimed) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		count(Q.reseal(nm + ".y"))
+		count(Q.reseal(metaName(nm)))
+		Q.release(nm)
+	}
+	for _, dir := range append([]string{DeadDir, QuarantineDir}, Q.doneDirs()...) {
+		dis, err := Q.readDir(dir)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for _, di := range dis {
+			if nm := di.Name(); len(nm) == 26+len(ext) && strings.HasSuffix(nm, ext) ||
+				len(nm) == 26+len(metaExt) && strings.HasSuffix(nm, metaExt) {
+				count(Q.reseal(path.Join(dir, nm)))
+			}
+		}
+	}
+	if dis, err = Q.readDir(BlobDir); err != nil {
+		errs = append(errs, err)
+	}
+	for _, di := range dis {
+		if isBlobName(di.Name()) {
+			count(Q.resealBlob(di.Name()))
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// sealedWithCurrent reports whether the file is sealed with the current key, or does not exist.
+func (Q *Queue) sealedWithCurrent(name string) bool {
+	b, err := Q.st.ReadFile(name)
+	return errors.Is(err, fs.ErrNotExist) || err == nil && Q.Keys.sealedWith(b, sealMagic)
+}
+
+// reseal the item (or metadata) file with the current key, iff it is not sealed with that already.
+func (Q *Queue) reseal(name string) (bool, error) {
+	b, err := Q.st.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil || Q.Keys.sealedWith(b, sealMagic) {
+		return false, err
+	}
+	if IsSealed(b) {
+		if b, err = Q.Keys.Open(b); err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return true, Q.writeFile(name, Q.Keys.Seal(b), 0400)
+}
+
+// resealBlob re-encrypts (and compresses) the blob with the current key, iff it is not encrypted with that already.
+func (Q *Queue) resealBlob(hash string) (bool, error) {
+	fn := path.Join(BlobDir, hash)
+	fh, err := Q.st.Open(fn)
+	if err != nil {
+		return false, err
+	}
+	hdr := make([]byte, blobHeaderLen)
+	_, _ = io.ReadFull(fh, hdr)
+	fh.Close()
+	if Q.Keys.sealedWith(hdr, blobMagic) {
+		return false, nil
+	}
+	if fh, err = Q.OpenBlob(hash); err != nil {
+		return false, err
+	}
+	defer fh.Close()
+	tmp := path.Join(BlobDir, ".tmp-"+ulid.Make().String())
+	if err = Q.writeBlob(tmp, fh); err == nil {
+		err = Q.st.Rename(tmp, fn)
+	}
+	if err != nil {
+		_ = Q.removeFile(tmp)
+		return false, fmt.Errorf("%s: %w", hash, err)
+	}
+	return true, nil
+}
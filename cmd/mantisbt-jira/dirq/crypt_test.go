@@ -0,0 +1,179 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncrypt(t *testing.T) {
+	ctx := context.Background()
+	key1, key2 := NewKey(), NewKey()
+	old, err := ParseKeys("# old\n" + key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.Keys = old
+	secret := []byte("secret comment")
+	if err = Q.Enqueue(secret, WithKey("secret key"), WithGroup("secret group")); err != nil {
+		t.Fatal(err)
+	}
+	blobs := make(map[string][]byte)
+	for _, size := range []int{0, 10, blobChunkSize, 2*blobChunkSize + 3} {
+		b := bytes.Repeat([]byte("secret attachment "), size/18+1)[:size]
+		hsh, err := Q.PutBlob(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs[hsh] = b
+		// The name of the blob does not reveal its contents.
+		if sum := sha256.Sum256(b); hsh == hex.EncodeToString(sum[:]) {
+			t.Errorf("%d: blob is named by its plain hash", size)
+		}
+	}
+	checkDup := func() {
+		t.Helper()
+		if err := Q.Enqueue([]byte("dup"), WithKey("secret key")); err != nil {
+			t.Fatal(err)
+		}
+		if entries, err := Q.List(); err != nil || len(entries) != 1 {
+			t.Fatalf("duplicate key: got %+v (%+v)", entries, err)
+		}
+	}
+	checkDup()
+	checkFiles := func() {
+		t.Helper()
+		if err := filepath.WalkDir(Q.Dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			b, err := os.ReadFile(path)
+			if bytes.Contains(b, []byte("secret")) {
+				t.Errorf("%s: plaintext", path)
+			}
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkBlobs := func() {
+		t.Helper()
+		for hsh, want := range blobs {
+			fh, err := Q.OpenBlob(hsh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fi, _ := fh.Stat()
+			b, err := io.ReadAll(fh)
+			fh.Close()
+			if err != nil {
+				t.Fatalf("%d: %+v", len(want), err)
+			}
+			if !bytes.Equal(b, want) || fi.Size() != int64(len(want)) {
+				t.Errorf("got %d (stat %d), wanted %d bytes", len(b), fi.Size(), len(want))
+			}
+		}
+	}
+	checkFiles()
+	checkBlobs()
+
+	// Without the key, the item is not dead-lettered, but it does not stall the queue.
+	Q.Keys = nil
+	Q.MaxAttempts = 1
+	if err = Q.Enqueue([]byte("plain")); err != nil {
+		t.Fatal(err)
+	}
+	var processed []string
+	if err = Q.Dequeue(ctx, func(_ context.Context, p []byte) error {
+		processed = append(processed, string(p))
+		return nil
+	}); !errors.Is(err, ErrNoKey) || !errors.Is(err, ErrTransient) {
+		t.Fatalf("no key: got %+v", err)
+	}
+	if len(processed) != 1 || processed[0] != "plain" {
+		t.Errorf("no key: processed %q, wanted [plain]", processed)
+	}
+	if entries, err := Q.List(); err != nil || len(entries) != 1 {
+		t.Fatalf("no key: got %+v (%+v)", entries, err)
+	}
+
+	// Rotate: the items of the old key remain readable.
+	if Q.Keys, err = ParseKeys(key2 + "," + key1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Q.Rekey(); err != nil || n != 2+len(blobs) {
+		t.Fatalf("rekey: %d (%+v)", n, err)
+	}
+	checkFiles()
+	// The blobs and the key marks are named with the old key.
+	checkBlobs()
+	checkDup()
+
+	// The sealed metadata is exported, and imported.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if _, err = Q.Export(tw, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("secret")) {
+		t.Error("export: plaintext")
+	}
+	dst, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	dst.Keys = Q.Keys
+	for tr := tar.NewReader(&buf); ; {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = dst.Import(hdr.Name, hdr, tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, err := dst.List(); err != nil || len(entries) != 1 || entries[0].Meta.Group != "secret group" {
+		t.Fatalf("import: got %+v (%+v)", entries, err)
+	}
+
+	if Q.Keys, err = ParseKeys(key2); err != nil {
+		t.Fatal(err)
+	}
+	var got []byte
+	if err = Q.Dequeue(ctx, func(_ context.Context, p []byte) error {
+		got = p
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Errorf("got %q, wanted %q", got, secret)
+	}
+
+	// Tampering is detected.
+	sealed := Q.Keys.Seal(secret)
+	sealed[len(sealed)-1] ^= 1
+	if _, err = Q.Keys.Open(sealed); err == nil {
+		t.Error("tampered: no error")
+	}
+}
@@ -1,22 +1,25 @@
 // Copyright 2024, 2025 Tamás Gulácsi. All rights reserved.
 
-// Packge dirq provides a directory+files based multiple provider,
-// single consumer persistent queue.
+// Package dirq provides a directory+files based persistent queue,
+// with multiple producers and multiple consumers: the consumer processes
+// sharing the queue take the items with leases (see LeaseDuration),
+// and each of them may process several groups concurrently (see Workers).
 package dirq
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
-	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 
-	"github.com/google/renameio/v2"
 	"github.com/oklog/ulid/v2"
 	"github.com/rjeczalik/notify"
 	"golang.org/x/time/rate"
@@ -24,42 +27,212 @@ import (
 
 const ext = ".dirq-item.dat"
 
+// DeadDir is the name of the dead-letter subdirectory of the queue.
+const DeadDir = "dead"
+
+const metaExt = ".dirq-meta.json"
+
 type Queue struct {
-	fh      *os.File
+	nextDue time.Time
+	mode    atomic.Value
+	st      Storage
 	limiter *rate.Limiter
-	Dir     string
+	// Backoff returns the delay after the n-th failed attempt of an item
+	// (DefaultBackoff if nil).
+	Backoff func(n int) time.Duration
+	// Dir is the directory of the queue (empty for the in-memory storage).
+	Dir string
+
+	// Payloads larger than CompressThreshold bytes are compressed
+	// (never if not positive).
+	CompressThreshold int
+
+	// KeyRetention is the time the idempotency keys are kept
+	// after their message has been processed.
+	KeyRetention time.Duration
+
+	// PollInterval is the interval of polling the directory in Watch,
+	// when notifications are not available.
+	PollInterval time.Duration
+
+	// Archive the processed items into DoneDir, instead of removing them.
+	Archive bool
+
+	// MaxItems and MaxBytes limit the number of items and the bytes
+	// stored in the queue (with the dead items and the blobs);
+	// Enqueue returns ErrFull when a limit is reached (no limit if not positive).
+	MaxItems int
+	MaxBytes int64
+
+	// Workers is the number of goroutines Dequeue processes the items with.
+	// The items of a group are always processed by the same goroutine, in order;
+	// an idle goroutine takes the next waiting group.
+	Workers int
+
+	// MaxAttempts is the number of failed attempts after which
+	// an item is moved to the dead-letter directory (0 means no limit).
+	MaxAttempts int
+
+	// LeaseDuration is the time a consumer may hold an item without renewing
+	// its lease - after that another consumer takes the item
+	// (DefaultLeaseDuration if not positive).
+	LeaseDuration time.Duration
+
+	// Keys encrypt the items and the blobs at rest (no encryption if nil).
+	// The encrypted items can be dequeued only with their key in Keys.
+	Keys *Keyring
+
+	// Observers are called on the lifecycle events of the items (see Event).
+	Observers []Observer
+
+	// owner identifies the consumer in the leases.
+	owner string
+
+	// seen are the names of the items already seen by Dequeue (see EventDiscovered).
+	seen map[string]struct{}
 
 	mu sync.Mutex
 }
 
-func (Q *Queue) Close() error {
-	fh := Q.fh
-	Q.fh = nil
-	if fh == nil {
-		return nil
+var (
+	// ErrPermanent marks an error as permanent: the item is moved to
+	// the dead-letter directory without further retries.
+	ErrPermanent = errors.New("permanent error")
+	// ErrTransient marks an error as not the fault of the item
+	// (for example an authentication or network error),
+	// thus it does not count as a failed attempt.
+	ErrTransient = errors.New("transient error")
+)
+
+// Meta is the processing state of an item,
+// stored in a sidecar file beside the item.
+type Meta struct {
+	FirstFailure time.Time
+	LastFailure  time.Time
+	// NextAttempt is the earliest time the item may be dequeued again.
+	NextAttempt time.Time
+	// NotBefore is the scheduled time of the item (see EnqueueAt).
+	NotBefore time.Time
+	Dead      time.Time
+	// Quarantined is the time the corrupt item has been moved to the quarantine directory.
+	Quarantined time.Time
+	// Done is the time of the successful processing of an archived item
+	// (or of an item which could not be removed, see isDone).
+	Done time.Time
+	// Group is the ordering group of the item.
+	Group     string
+	LastError string
+	// Key is the idempotency key of the item.
+	Key string `json:",omitempty"`
+	// Blobs are the hashes of the blobs referenced by the item.
+	Blobs []string `json:",omitempty"`
+	// Result is the result of the processing of an archived item (see SetResult).
+	Result   json.RawMessage `json:",omitempty"`
+	Attempts int
+}
+
+// DeadLetterError is returned by Dequeue when an item has been moved
+// to the dead-letter directory.
+type DeadLetterError struct {
+	Err  error
+	Name string
+	Meta Meta
+}
+
+func (de *DeadLetterError) Error() string {
+	return fmt.Sprintf("%s moved to %s after %d attempts: %v", de.Name, DeadDir, de.Meta.Attempts, de.Err)
+}
+func (de *DeadLetterError) Unwrap() error { return de.Err }
+
+// Close the storage of the queue.
+func (Q *Queue) Close() error { return Q.st.Close() }
+
+func newQueue(st Storage) *Queue {
+	return &Queue{
+		st: st, limiter: rate.NewLimiter(1, 1),
+		CompressThreshold: DefaultCompressThreshold,
+		KeyRetention:      DefaultKeyRetention,
+		PollInterval:      DefaultPollInterval,
+		LeaseDuration:     DefaultLeaseDuration,
+		owner:             newOwner(),
 	}
-	defer fh.Close()
-	return syscall.Flock(int(fh.Fd()), syscall.LOCK_UN)
 }
 
-func New(dir string) (*Queue, error) {
-	return &Queue{Dir: dir, limiter: rate.NewLimiter(1, 1)}, nil
+// Storage returns the storage of the queue.
+func (Q *Queue) Storage() Storage { return Q.st }
+
+// An Option sets the initial metadata of an enqueued message.
+type Option func(*Meta)
+
+// WithGroup sets the ordering group of the message:
+// messages of the same group are processed strictly in order,
+// a failing message blocks only the later messages of its group.
+//
+// Messages without a group are not ordered.
+func WithGroup(group string) Option { return func(m *Meta) { m.Group = group } }
+
+// EnqueueAt enqueues a message which must not be dequeued before t.
+//
+// A scheduled message does not block the later messages of its group
+// till it is due.
+func (Q *Queue) EnqueueAt(t time.Time, p []byte, options ...Option) error {
+	return Q.Enqueue(p, append(options, func(m *Meta) { m.NotBefore = t })...)
 }
 
 // Enqueue a message.
 //
 // Does not lock (not needed).
-func (Q *Queue) Enqueue(p []byte) error {
-	fn := filepath.Join(
-		Q.Dir,
-		ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()).String()+ext)
-	slog.Debug("Enqueue", "file", fn)
-	return renameio.WriteFile(fn, p, 0400)
+// Returns ErrFull if the queue has reached its limits (see MaxItems, MaxBytes).
+func (Q *Queue) Enqueue(p []byte, options ...Option) error {
+	nm := ulid.MustNew(ulid.Now(), ulid.DefaultEntropy()).String() + ext
+	b := encode(p, Q.CompressThreshold)
+	if Q.Keys != nil {
+		b = Q.Keys.Seal(b)
+	}
+	if err := Q.checkQuota(true, int64(len(b))); err != nil {
+		return err
+	}
+	var m Meta
+	if len(options) != 0 {
+		for _, o := range options {
+			o(&m)
+		}
+		if m.Key != "" {
+			if dup, err := Q.reserveKey(m.Key, nm); err != nil {
+				return err
+			} else if dup {
+				slog.Info("Enqueue duplicate", "key", m.Key)
+				return nil
+			}
+		}
+		// The metadata must be there before the item appears.
+		if err := Q.writeMeta(".", nm, m); err != nil {
+			Q.releaseKey(m.Key)
+			return err
+		}
+	}
+	slog.Debug("Enqueue", "dir", Q.Dir, "name", nm)
+	if err := Q.writeFile(nm, b, 0400); err != nil {
+		Q.releaseKey(m.Key)
+		return err
+	}
+	Q.observe(EventEnqueued, &item{Name: nm, Meta: m, size: len(p)}, nil)
+	return nil
 }
 
-// DequeueOne will call f on the first dequeueable message.
+// Dequeue will call f on the dequeueable messages, in order
+// (possibly concurrently for different groups, see Workers).
 // The message will be deleted iff f returns nil,
-// otherwise it remains in the queue.
+// otherwise it remains in the queue, and won't be dequeued
+// till its backoff delay passes.
+//
+// Items that are not due yet (in backoff) are skipped, with the later items of their group,
+// the scheduled items (see EnqueueAt) only by themselves.
+// Transient errors (ErrTransient) stop the processing.
+//
+// Several consumers (processes) may dequeue the same queue: each item is
+// claimed under a lease (see LeaseDuration), and a group with an item
+// in flight at another consumer is skipped.
 func (Q *Queue) Dequeue(ctx context.Context, f func(context.Context, []byte) error) error {
 	if err := ctx.Err(); err != nil {
 		slog.Error("Dequeue", "error", err)
@@ -67,11 +240,9 @@ func (Q *Queue) Dequeue(ctx context.Context, f func(context.Context, []byte) err
 	}
 	Q.mu.Lock()
 	defer Q.mu.Unlock()
-	if err := Q.lock(); err != nil {
-		slog.Error("lock", "error", err)
-		return err
-	}
-	dis, err := os.ReadDir(Q.Dir)
+	// Forget the delayed item of the previous pass, it may be gone.
+	Q.nextDue = time.Time{}
+	dis, err := Q.st.ReadDir(".")
 	if len(dis) == 0 {
 		if err != nil {
 			slog.Error("ReadDir", "dir", Q.Dir, "error", err)
@@ -79,75 +250,351 @@ func (Q *Queue) Dequeue(ctx context.Context, f func(context.Context, []byte) err
 		// slog.Debug("empty", "dir", Q.Dir)
 		return err
 	}
+	now := time.Now()
 	names := make([]string, 0, len(dis))
+	var inFlight []string
+	metas := make(map[string]struct{})
+	leases := make(map[string]struct{})
 	for _, di := range dis {
 		nm := di.Name()
-		if di.Type().IsRegular() && strings.HasSuffix(nm, ext) &&
-			len(nm) == 26+len(ext) {
+		if !di.Type().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(nm, ext) && len(nm) == 26+len(ext) {
 			names = append(names, nm)
+		} else if strings.HasSuffix(nm, ext+".y") && len(nm) == 26+len(ext)+2 {
+			// Make the items of the crashed consumers pending again.
+			if Q.breakLease(nm, now) {
+				names = append(names, nm[:len(nm)-2])
+			} else {
+				inFlight = append(inFlight, nm[:len(nm)-2])
+			}
+		} else if strings.HasSuffix(nm, metaExt) && len(nm) == 26+len(metaExt) {
+			metas[nm] = struct{}{}
+		} else if strings.HasSuffix(nm, leaseExt) && len(nm) == 26+len(leaseExt) {
+			leases[nm[:26]] = struct{}{}
+		}
+	}
+	Q.removeOrphans(names, inFlight, metas, leases, now)
+	// Forget the items gone, but not the ones in flight at another consumer.
+	seen := make(map[string]struct{}, len(names)+len(inFlight))
+	for _, nm := range inFlight {
+		if _, ok := Q.seen[nm]; ok {
+			seen[nm] = struct{}{}
 		}
 	}
+	prevSeen := Q.seen
+	Q.seen = seen
 	// slog.Debug("ReadDir2", "names", names)
 	if len(names) == 0 {
 		return ErrEmpty
 	}
 	slices.Sort(names)
+	// Collect the due items, skipping the groups blocked by a delayed item,
+	// or by an item in flight at another consumer.
+	todo := make([]item, 0, len(names))
+	blocked := make(map[string]struct{})
+	for _, nm := range inFlight {
+		if _, ok := metas[metaName(nm)]; !ok {
+			continue
+		}
+		if m, err := Q.readMeta(nm); err != nil {
+			slog.Error("readMeta", "name", nm, "error", err)
+		} else if m.Group != "" {
+			blocked[m.Group] = struct{}{}
+		}
+	}
 	for _, nm := range names {
-		if err := Q.dequeueOne(ctx, f, filepath.Join(Q.fh.Name(), nm)); err != nil {
-			slog.Error("dequeueOne", "name", nm, "error", err)
-			return err
+		it := item{Name: nm}
+		if _, it.hasMeta = metas[metaName(nm)]; it.hasMeta {
+			if it.Meta, err = Q.readMeta(nm); err != nil {
+				slog.Error("readMeta", "name", nm, "error", err)
+				if errors.Is(err, ErrNoKey) {
+					it.metaErr = err
+				}
+			}
 		}
-		slog.Info("dequeueOne", "name", nm)
+		seen[nm] = struct{}{}
+		if _, ok := prevSeen[nm]; !ok {
+			Q.observe(EventDiscovered, &it, nil)
+		}
+		if it.Group != "" {
+			if _, ok := blocked[it.Group]; ok {
+				slog.Debug("blocked", "name", nm, "group", it.Group)
+				continue
+			}
+		}
+		if !it.Due(now) {
+			next := it.DueAt()
+			slog.Debug("not due", "name", nm, "next", next)
+			if Q.nextDue.IsZero() || next.Before(Q.nextDue) {
+				Q.nextDue = next
+			}
+			if it.Group != "" && now.Before(it.NextAttempt) {
+				blocked[it.Group] = struct{}{}
+			}
+			continue
+		}
+		todo = append(todo, it)
 	}
-	return nil
+
+	setLater(todo)
+
+	workers := max(1, Q.Workers)
+	if workers == 1 || len(todo) == 1 {
+		return errors.Join(Q.process(ctx, f, todo, nil)...)
+	}
+	// Queue the items by their group, in the order of their first items:
+	// the idle workers take the next group, so a slow group
+	// does not hold up the others.
+	var groups [][]item
+	groupIdx := make(map[string]int)
+	for _, it := range todo {
+		k := cmp.Or(it.Group, it.Name)
+		if i, ok := groupIdx[k]; ok {
+			groups[i] = append(groups[i], it)
+			continue
+		}
+		groupIdx[k] = len(groups)
+		groups = append(groups, []item{it})
+	}
+	work := make(chan []item, len(groups))
+	for _, g := range groups {
+		work <- g
+	}
+	close(work)
+	var (
+		wg      sync.WaitGroup
+		errsMu  sync.Mutex
+		errs    []error
+		stopped atomic.Bool
+	)
+	for range min(workers, len(groups)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g := range work {
+				if es := Q.process(ctx, f, g, &stopped); len(es) != 0 {
+					errsMu.Lock()
+					errs = append(errs, es...)
+					errsMu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+type item struct {
+	Name string
+	Meta
+	hasMeta bool
+	// metaErr is the error reading the metadata without its key (see ErrNoKey).
+	metaErr error
+	// size of the payload, and the duration of its processing, for the Observers.
+	size int
+	took time.Duration
+	// later are the IDs of the later due items of the group (see LaterInGroup).
+	later []string
 }
 
-func (Q *Queue) lock() error {
-	if Q.fh != nil {
-		return nil
+// setLater records the later items of its group in each item.
+func setLater(todo []item) {
+	ids := make(map[string][]string)
+	for _, it := range todo {
+		if it.Group != "" {
+			ids[it.Group] = append(ids[it.Group], it.Name[:26])
+		}
 	}
-	var err error
-	if Q.fh, err = os.Open(Q.Dir); err != nil {
-		return err
+	seen := make(map[string]int, len(ids))
+	for i, it := range todo {
+		if it.Group != "" {
+			seen[it.Group]++
+			todo[i].later = ids[it.Group][seen[it.Group]:]
+		}
 	}
-	if err = syscall.Flock(int(Q.fh.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
-		Q.Close()
-		return fmt.Errorf("cannot flock directory %s - %s (possibly in use by another instance of dirq)", Q.Dir, err)
+}
+
+// process the items in order, stopping a group at the first failure.
+//
+// A transient error stops all the processing, signaled through stopped.
+func (Q *Queue) process(ctx context.Context, f func(context.Context, []byte) error, items []item, stopped *atomic.Bool) []error {
+	if stopped == nil {
+		stopped = new(atomic.Bool)
 	}
-	dis, err := Q.fh.ReadDir(-1)
-	if len(dis) == 0 && err != nil {
-		Q.Close()
-		return err
+	var errs []error
+	blocked := make(map[string]struct{})
+	for _, it := range items {
+		if stopped.Load() || ctx.Err() != nil {
+			break
+		}
+		nm := it.Name
+		if it.Group != "" {
+			if _, ok := blocked[it.Group]; ok {
+				slog.Debug("blocked", "name", nm, "group", it.Group)
+				continue
+			}
+		}
+		if err := Q.dequeueOne(ctx, f, &it); err != nil {
+			if errors.Is(err, errDone) {
+				slog.Warn("skip already processed", "name", nm, "key", it.Key)
+				Q.observe(EventSkipped, &it, nil)
+				continue
+			}
+			if errors.Is(err, errClaimed) {
+				// Another consumer processes it (and the rest of its group).
+				slog.Debug("claimed", "name", nm, "group", it.Group)
+				if it.Group != "" {
+					blocked[it.Group] = struct{}{}
+				}
+				continue
+			}
+			slog.Error("dequeueOne", "name", nm, "group", it.Group, "error", err)
+			if errors.Is(err, ErrCorrupt) {
+				// It would never succeed, but it does not block its group either.
+				if qErr := Q.quarantine(nm, it.Meta, err); errors.As(qErr, new(*QuarantineError)) {
+					slog.Warn("quarantine", "name", nm, "error", qErr)
+					Q.observe(EventQuarantined, &it, err)
+					err = qErr
+				} else if it.Group != "" {
+					blocked[it.Group] = struct{}{}
+				}
+				errs = append(errs, err)
+				continue
+			}
+			if errors.Is(err, ErrNoKey) {
+				// Only this item is unreadable (until its key is added),
+				// so skip it (and its group), but not the rest of the queue.
+				Q.release(nm)
+				Q.observe(EventFailed, &it, err)
+				if it.Group != "" {
+					blocked[it.Group] = struct{}{}
+				}
+				errs = append(errs, err)
+				continue
+			}
+			if errors.Is(err, ErrTransient) && !errors.Is(err, ErrPermanent) {
+				Q.release(nm)
+				Q.observe(EventFailed, &it, err)
+				stopped.Store(true)
+				return append(errs, err)
+			}
+			dlErr := Q.fail(nm, it.Meta, err)
+			it.Attempts++
+			if dlErr != nil {
+				slog.Warn("dead letter", "name", nm, "error", dlErr)
+				Q.observe(EventDeadLettered, &it, err)
+				err = dlErr
+			} else {
+				Q.observe(EventFailed, &it, err)
+				if it.Group != "" {
+					blocked[it.Group] = struct{}{}
+				}
+			}
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("dequeueOne", "name", nm)
+		Q.observe(EventSucceeded, &it, nil)
 	}
-	for _, di := range dis {
-		if nm := di.Name(); len(nm) == 26+len(ext)+2 && strings.HasSuffix(nm, ext+".y") {
-			_ = os.Rename(filepath.Join(Q.Dir, nm), filepath.Join(Q.Dir, nm[:len(nm)-2]))
+	return errs
+}
+
+// NextDue returns the earliest time a delayed item becomes due,
+// as seen by the last Dequeue - the zero time if there is no such item.
+func (Q *Queue) NextDue() time.Time {
+	Q.mu.Lock()
+	defer Q.mu.Unlock()
+	return Q.nextDue
+}
+
+// removeOrphans removes the metadata without item - but not the ones just being enqueued,
+// and the expired leases without in-flight item.
+func (Q *Queue) removeOrphans(names, inFlight []string, metas, leases map[string]struct{}, now time.Time) {
+	items := make(map[string]struct{}, len(names)+len(inFlight))
+	for _, nm := range names {
+		items[nm[:26]] = struct{}{}
+	}
+	for _, nm := range inFlight {
+		items[nm[:26]] = struct{}{}
+	}
+	for nm := range metas {
+		if _, ok := items[nm[:26]]; ok {
+			continue
+		}
+		if id, err := ulid.ParseStrict(nm[:26]); err == nil && now.Sub(ulid.Time(id.Time())) > time.Minute {
+			_ = Q.st.Remove(nm)
+		}
+	}
+	for id := range leases {
+		if _, ok := items[id]; ok {
+			continue
+		}
+		if l, err := Q.readLease(id); err == nil && l.Expired(now) {
+			_ = Q.st.Remove(leaseName(id))
 		}
 	}
-	return nil
 }
 
 var ErrEmpty = errors.New("queue is empty")
 
+// Watch modes.
+const (
+	// ModeNotify is the notification based watch mode.
+	ModeNotify = "notify"
+	// ModePoll is the polling watch mode, used when notifications are
+	// not available (NFS, bind mounts).
+	ModePoll = "poll"
+)
+
+// DefaultPollInterval is the default PollInterval.
+const DefaultPollInterval = time.Minute
+
+// WatchMode returns the active mode of Watch (ModeNotify or ModePoll),
+// or the empty string if Watch is not running.
+func (Q *Queue) WatchMode() string {
+	mode, _ := Q.mode.Load().(string)
+	return mode
+}
+
 // Dequeue all the incoming messages, continuously.
 //
-// Calls dequeueOne when a new message arrives (based on notification).
+// Calls Dequeue at start, and when a new message arrives (based on notification).
+// If the notification cannot be set up, or it misses events,
+// Watch switches to polling the directory every PollInterval.
 func (Q *Queue) Watch(ctx context.Context, f func(context.Context, []byte) error) error {
-	Q.mu.Lock()
-	err := Q.lock()
-	Q.mu.Unlock()
-	if err != nil {
-		return err
-	}
-	c := make(chan notify.EventInfo)
-	if err := notify.Watch(Q.Dir, c, notify.InMoveSelf, notify.InMovedTo); err != nil {
-		return err
+	interval := Q.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
 	}
-	defer notify.Stop(c)
 
 	evts := make(chan error, 1)
+	kick := func() {
+		select {
+		case evts <- nil:
+		default:
+		}
+	}
+	// Wait for the in-flight Dequeue on return.
+	ctx, cancel := context.WithCancel(ctx)
+	exited := make(chan struct{})
+	defer func() { cancel(); <-exited }()
 	go func() {
-		for err := range evts {
+		defer close(exited)
+		var timer *time.Timer
+		defer func() {
+			if timer != nil {
+				timer.Stop()
+			}
+		}()
+		for {
+			var err error
+			select {
+			case <-ctx.Done():
+				return
+			case err = <-evts:
+			}
 			if err != nil {
 				slog.Warn("evts EXIT", "error", err)
 				return
@@ -155,17 +602,65 @@ func (Q *Queue) Watch(ctx context.Context, f func(context.Context, []byte) error
 			if err = Q.Dequeue(ctx, f); err != nil {
 				slog.Error("Dequeue", "error", err)
 			}
+			// Wake up when the next delayed item becomes due.
+			if next := Q.NextDue(); next.After(time.Now()) {
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(time.Until(next), kick)
+			}
 		}
 	}()
 
+	// Only the directory storage has notifications.
+	c := make(chan notify.EventInfo)
+	if _, ok := Q.st.(*dirStorage); !ok {
+		c = nil
+		Q.mode.Store(ModePoll)
+	} else if err := notify.Watch(Q.Dir, c, notify.InMoveSelf, notify.InMovedTo); err != nil {
+		slog.Warn("notify", "dir", Q.Dir, "error", err)
+		c = nil
+		Q.mode.Store(ModePoll)
+	} else {
+		Q.mode.Store(ModeNotify)
+	}
+	defer func() {
+		if c != nil {
+			notify.Stop(c)
+		}
+		Q.mode.Store("")
+	}()
+	slog.Info("Watch", "dir", Q.Dir, "mode", Q.WatchMode(), "interval", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	lastEvent := time.Now()
+	// The items enqueued before the notification has been set up.
+	kick()
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
+		case <-ticker.C:
+			if c != nil {
+				if !Q.missedEvents(lastEvent, interval) {
+					// Break the expired leases of the other consumers.
+					if Q.expiredLease() {
+						kick()
+					}
+					continue
+				}
+				notify.Stop(c)
+				c = nil
+				Q.mode.Store(ModePoll)
+				slog.Warn("notify missed events", "dir", Q.Dir, "mode", ModePoll, "interval", interval)
+			}
+			kick()
 		case ei, ok := <-c:
 			if !ok {
 				return ctx.Err()
 			}
+			lastEvent = time.Now()
 			bn := filepath.Base(ei.Path())
 			slog.Debug("notify", "path", ei.Path(), "length", len(bn)-len(ext))
 			if len(bn) == 26+len(ext) && strings.HasSuffix(bn, ext) {
@@ -176,27 +671,201 @@ func (Q *Queue) Watch(ctx context.Context, f func(context.Context, []byte) error
 					}
 					return err
 				}
-				select {
-				case evts <- nil:
-				default:
-				}
+				kick()
 			}
 		}
 	}
 }
 
-func (Q *Queue) dequeueOne(ctx context.Context, f func(context.Context, []byte) error, fn string) error {
-	fny := fn + ".y"
-	if err := os.Rename(fn, fny); err != nil {
+// missedEvents reports whether there is an item that has been enqueued
+// after the last event, at least grace ago - thus its event has been missed.
+func (Q *Queue) missedEvents(lastEvent time.Time, grace time.Duration) bool {
+	dis, _ := Q.st.ReadDir(".")
+	for _, di := range dis {
+		nm := di.Name()
+		if !(len(nm) == 26+len(ext) && strings.HasSuffix(nm, ext)) {
+			continue
+		}
+		id, err := ulid.ParseStrict(nm[:26])
+		if err != nil {
+			continue
+		}
+		if t := ulid.Time(id.Time()); t.After(lastEvent) && time.Since(t) > grace {
+			return true
+		}
+	}
+	return false
+}
+
+// expiredLease reports whether there is an expired lease.
+func (Q *Queue) expiredLease() bool {
+	now := time.Now()
+	dis, _ := Q.st.ReadDir(".")
+	for _, di := range dis {
+		nm := di.Name()
+		if !(len(nm) == 26+len(leaseExt) && strings.HasSuffix(nm, leaseExt)) {
+			continue
+		}
+		if l, err := Q.readLease(nm[:26]); err == nil && l.Expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// errDone is returned by dequeueOne for an item which has already been processed.
+var errDone = errors.New("already processed")
+
+// dequeueOne claims the item and calls f with its payload.
+//
+// On error, the item remains claimed (see fail and release) - except for errClaimed and errDone.
+func (Q *Queue) dequeueOne(ctx context.Context, f func(context.Context, []byte) error, it *item) error {
+	nm, key := it.Name, it.Key
+	nmy := nm + ".y"
+	if err := Q.claim(nm); err != nil {
 		return err
 	}
-	b, err := os.ReadFile(fny)
+	if it.metaErr != nil {
+		return fmt.Errorf("%s: %w", nm, it.metaErr)
+	}
+	if Q.isDone(it) {
+		Q.removeDone(nmy, it)
+		return errDone
+	}
+	b, err := Q.st.ReadFile(nmy)
 	if err != nil {
 		return err
 	}
-	if err := f(ctx, b); err != nil {
-		_ = os.Rename(fny, fn)
+	if b, err = Q.decode(b); err != nil {
+		if errors.Is(err, ErrNoKey) || errors.Is(err, ErrCorrupt) {
+			return fmt.Errorf("%s: %w", nm, err)
+		}
+		return fmt.Errorf("%w: %s: %w", ErrPermanent, nm, err)
+	}
+	it.size = len(b)
+	Q.observe(EventDequeued, it, nil)
+	start := time.Now()
+	defer func() { it.took = time.Since(start) }()
+	st := itemState{ID: nm[:26], Later: it.later}
+	fctx, cancel := context.WithCancel(context.WithValue(ctx, itemStateKey{}, &st))
+	renewCtx, stopRenew := context.WithCancel(ctx)
+	var lost atomic.Bool
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		Q.renew(renewCtx, nm, func() { lost.Store(true); cancel() })
+	}()
+	err = f(fctx, b)
+	stopRenew()
+	<-renewed
+	cancel()
+	if lost.Load() {
+		// The item belongs to another consumer now.
+		return fmt.Errorf("%s: lease lost: %w", nm, errClaimed)
+	}
+	if err != nil {
 		return err
 	}
-	return os.Remove(fny)
+	if key != "" {
+		if err := Q.markDone(key, nm); err != nil {
+			slog.Error("markDone", "name", nm, "key", key, "error", err)
+		}
+	}
+	Q.complete(nmy, it, st.Result)
+	return nil
+}
+
+// complete archives (or removes) the processed item.
+//
+// The item has been processed, thus the failures here are only logged:
+// if the archiving fails, the item is removed (see removeDone).
+func (Q *Queue) complete(nmy string, it *item, result json.RawMessage) {
+	if Q.Archive {
+		err := Q.archive(nmy, *it, result)
+		if err == nil {
+			Q.removed(nmy, it)
+			return
+		}
+		slog.Error("archive", "name", it.Name, "error", err)
+	}
+	Q.removeDone(nmy, it)
+}
+
+// removed removes the metadata and the lease of the archived (or removed) item.
+func (Q *Queue) removed(nmy string, it *item) {
+	if it.hasMeta || it.Attempts != 0 {
+		if err := Q.removeMeta(it.Name); err != nil {
+			slog.Warn("removeMeta", "name", it.Name, "error", err)
+		}
+	}
+	_ = Q.finish(nmy, nil)
+}
+
+// removeDone removes the processed item.
+//
+// If the file cannot be removed, the item is marked done in its metadata
+// (checked by isDone), and its lease is kept: when it expires,
+// the next Dequeue tries to remove the item again, without processing it.
+func (Q *Queue) removeDone(nmy string, it *item) {
+	err := Q.st.Remove(nmy)
+	if err == nil {
+		Q.removed(nmy, it)
+		return
+	}
+	slog.Error("remove processed item", "name", it.Name, "error", err)
+	if !it.Done.IsZero() {
+		return
+	}
+	m := it.Meta
+	m.Done = time.Now()
+	if err = Q.writeMeta(".", it.Name, m); err != nil {
+		slog.Error("mark processed item done", "name", it.Name, "error", err)
+	}
+}
+
+// finish removes the lease of the processed item - iff err is nil.
+func (Q *Queue) finish(nmy string, err error) error {
+	if err == nil {
+		_ = Q.removeFile(leaseName(nmy[:26]))
+	}
+	return err
+}
+
+type itemStateKey struct{}
+
+// itemState is the state of the item being processed, passed in the context.
+type itemState struct {
+	ID     string
+	Result json.RawMessage
+	Later  []string
+}
+
+// ItemID returns the ID of the item being processed,
+// from the context passed to the function given to Dequeue.
+func ItemID(ctx context.Context) string {
+	if st, _ := ctx.Value(itemStateKey{}).(*itemState); st != nil {
+		return st.ID
+	}
+	return ""
+}
+
+// LaterInGroup returns the IDs of the later items of the group of the item being processed,
+// which were due when Dequeue has listed the queue - they may be gone since.
+//
+// Must be called from the function given to Dequeue, with its context.
+func LaterInGroup(ctx context.Context) []string {
+	if st, _ := ctx.Value(itemStateKey{}).(*itemState); st != nil {
+		return st.Later
+	}
+	return nil
+}
+
+// SetResult records the result (JSON) of the processing of the item,
+// which is archived with the item (see Archive).
+//
+// Must be called from the function given to Dequeue, with its context.
+func SetResult(ctx context.Context, result json.RawMessage) {
+	if st, _ := ctx.Value(itemStateKey{}).(*itemState); st != nil {
+		st.Result = result
+	}
 }
@@ -0,0 +1,1183 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+func TestDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.MaxAttempts = 2
+	Q.Backoff = func(int) time.Duration { return 0 }
+	if err = Q.Enqueue([]byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Enqueue([]byte("good")); err != nil {
+		t.Fatal(err)
+	}
+	errBad := errors.New("bad")
+	var got []string
+	f := func(_ context.Context, p []byte) error {
+		if string(p) == "bad" {
+			return errBad
+		}
+		got = append(got, string(p))
+		return nil
+	}
+
+	if err = Q.Dequeue(ctx, f); !errors.Is(err, errBad) {
+		t.Fatalf("first: got %v, wanted %v", err, errBad)
+	}
+	var dlErr *DeadLetterError
+	if errors.As(err, &dlErr) {
+		t.Fatalf("first: got dead letter %v", dlErr)
+	}
+	if err = Q.Dequeue(ctx, f); !errors.As(err, &dlErr) {
+		t.Fatalf("second: got %v, wanted DeadLetterError", err)
+	}
+	if dlErr.Meta.Attempts != 2 {
+		t.Errorf("got %d attempts, wanted 2", dlErr.Meta.Attempts)
+	}
+	if len(got) != 1 || got[0] != "good" {
+		t.Errorf("got %q, wanted [good]", got)
+	}
+	dis, err := os.ReadDir(filepath.Join(Q.Dir, DeadDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dis) != 2 {
+		t.Errorf("got %d files in %s, wanted item+meta", len(dis), DeadDir)
+	}
+	if err = Q.Dequeue(ctx, f); !errors.Is(err, ErrEmpty) {
+		t.Errorf("got %v, wanted %v", err, ErrEmpty)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	if err = Q.Enqueue([]byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+	var dlErr *DeadLetterError
+	if err = Q.Dequeue(context.Background(), func(context.Context, []byte) error {
+		return fmt.Errorf("%w: %w", ErrPermanent, errors.New("bad"))
+	}); !errors.As(err, &dlErr) {
+		t.Fatalf("got %v, wanted DeadLetterError", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.Backoff = func(int) time.Duration { return time.Hour }
+	if err = Q.Enqueue([]byte("bad")); err != nil {
+		t.Fatal(err)
+	}
+	var calls int
+	f := func(context.Context, []byte) error { calls++; return errors.New("bad") }
+	if err = Q.Dequeue(ctx, f); err == nil {
+		t.Fatal("wanted error")
+	}
+	if err = Q.Dequeue(ctx, f); err != nil {
+		t.Fatalf("not due: got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, wanted 1", calls)
+	}
+	if next := Q.NextDue(); time.Until(next) < 59*time.Minute {
+		t.Errorf("next due is %v", next)
+	}
+
+	// the metadata survives a restart
+	Q.Close()
+	if Q, err = New(Q.Dir); err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	if err = Q.Dequeue(ctx, f); err != nil || calls != 1 {
+		t.Fatalf("after restart: got %v (calls=%d)", err, calls)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.Backoff = func(int) time.Duration { return 0 }
+	for _, s := range []string{"A1", "B1", "A2", "B2"} {
+		if err = Q.Enqueue([]byte(s), WithGroup(s[:1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	failA := true
+	f := func(_ context.Context, p []byte) error {
+		if failA && p[0] == 'A' {
+			return errors.New("A is blocked")
+		}
+		got = append(got, string(p))
+		return nil
+	}
+	if err = Q.Dequeue(ctx, f); err == nil {
+		t.Fatal("wanted error")
+	}
+	if want := "[B1 B2]"; fmt.Sprintf("%v", got) != want {
+		t.Errorf("got %v, wanted %s", got, want)
+	}
+	failA = false
+	if err = Q.Dequeue(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[B1 B2 A1 A2]"; fmt.Sprintf("%v", got) != want {
+		t.Errorf("got %v, wanted %s", got, want)
+	}
+}
+
+func TestLaterInGroup(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	for _, s := range []string{"A1", "B1", "A2", "A3"} {
+		if err = Q.Enqueue([]byte(s), WithGroup(s[:1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = Q.EnqueueAt(time.Now().Add(time.Hour), []byte("A4"), WithGroup("A")); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int)
+	if err = Q.Dequeue(context.Background(), func(ctx context.Context, p []byte) error {
+		got[string(p)] = len(LaterInGroup(ctx))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The scheduled A4 is not due.
+	if want := "map[A1:2 A2:1 A3:0 B1:0]"; fmt.Sprintf("%v", got) != want {
+		t.Errorf("got %v, wanted %s", got, want)
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.Workers = 4
+	const groups, n = 8, 10
+	for i := range n {
+		for g := range groups {
+			if err = Q.Enqueue([]byte{byte(g), byte(i)}, WithGroup(fmt.Sprintf("G%d", g))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var mu sync.Mutex
+	got := make([][]byte, groups)
+	if err = Q.Dequeue(context.Background(), func(_ context.Context, p []byte) error {
+		mu.Lock()
+		got[p[0]] = append(got[p[0]], p[1])
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for g, seq := range got {
+		if len(seq) != n {
+			t.Errorf("%d. got %d items, wanted %d", g, len(seq), n)
+		}
+		for i, j := range seq {
+			if int(j) != i {
+				t.Errorf("%d. out of order: %v", g, seq)
+				break
+			}
+		}
+	}
+}
+
+func TestWorkersSlowGroup(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.Workers = 2
+	const groups = 8
+	for g := range groups {
+		if err = Q.Enqueue([]byte{byte(g)}, WithGroup(fmt.Sprintf("G%d", g))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first group waits for all the others:
+	// they must be processed by the other worker meanwhile.
+	others := make(chan struct{}, groups)
+	if err = Q.Dequeue(context.Background(), func(_ context.Context, p []byte) error {
+		if p[0] != 0 {
+			others <- struct{}{}
+			return nil
+		}
+		for range groups - 1 {
+			select {
+			case <-others:
+			case <-time.After(5 * time.Second):
+				return errors.New("the other groups are held up by the slow one")
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlob(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	hsh, err := Q.PutBlob(strings.NewReader("attachment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := Q.PutBlob(strings.NewReader("orphan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Enqueue([]byte(hsh), WithBlobs(hsh)); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.GCBlobs(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Q.OpenBlob(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan blob: got %v, wanted not exist", err)
+	}
+	if err = Q.Dequeue(ctx, func(_ context.Context, p []byte) error {
+		fh, err := Q.OpenBlob(string(p))
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+		b, err := io.ReadAll(fh)
+		if err != nil {
+			return err
+		}
+		if string(b) != "attachment" {
+			t.Errorf("got %q", b)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.GCBlobs(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Q.OpenBlob(hsh); !os.IsNotExist(err) {
+		t.Errorf("processed blob: got %v, wanted not exist", err)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.CompressThreshold = 16
+	small, large := []byte("small"), bytes.Repeat([]byte("large "), 1000)
+	for _, p := range [][]byte{small, large} {
+		if err = Q.Enqueue(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// an item written by the earlier versions, without header
+	if err = os.WriteFile(filepath.Join(Q.Dir, ulid.Make().String()+ext), []byte("legacy"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	dis, err := os.ReadDir(Q.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, di := range dis {
+		if fi, err := di.Info(); err != nil {
+			t.Fatal(err)
+		} else if fi.Size() > int64(len(large)/2) {
+			t.Errorf("%s is not compressed (%d bytes)", di.Name(), fi.Size())
+		}
+	}
+	var got [][]byte
+	if err = Q.Dequeue(context.Background(), func(_ context.Context, p []byte) error {
+		got = append(got, bytes.Clone(p))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || !bytes.Equal(got[0], small) || !bytes.Equal(got[1], large) || string(got[2]) != "legacy" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCompressBlob(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.CompressThreshold = 16
+	small, large := []byte("small"), bytes.Repeat([]byte("large "), 1000)
+	blobs := make(map[string][]byte)
+	for _, p := range [][]byte{small, large} {
+		hsh, err := Q.PutBlob(bytes.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs[hsh] = p
+	}
+	// a blob written by the earlier versions, without header
+	legacy := []byte("legacy")
+	sum := sha256.Sum256(legacy)
+	hsh := hex.EncodeToString(sum[:])
+	if err = os.WriteFile(filepath.Join(Q.Dir, BlobDir, hsh), legacy, 0400); err != nil {
+		t.Fatal(err)
+	}
+	blobs[hsh] = legacy
+	for hsh, want := range blobs {
+		if fi, err := os.Stat(filepath.Join(Q.Dir, BlobDir, hsh)); err != nil {
+			t.Fatal(err)
+		} else if fi.Size() > int64(len(large)/2) {
+			t.Errorf("%s is not compressed (%d bytes)", hsh, fi.Size())
+		}
+		fh, err := Q.OpenBlob(hsh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := fh.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(fh)
+		fh.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, want) || fi.Size() != int64(len(want)) {
+			t.Errorf("got %d (stat %d), wanted %d bytes", len(b), fi.Size(), len(want))
+		}
+	}
+}
+
+func TestKey(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	for range 2 {
+		if err = Q.Enqueue([]byte("comment"), WithKey("bugnote-1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var calls int
+	f := func(context.Context, []byte) error { calls++; return nil }
+	if err = Q.Dequeue(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, wanted 1", calls)
+	}
+	// within the retention
+	if err = Q.Enqueue([]byte("comment"), WithKey("bugnote-1")); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Dequeue(ctx, f); !errors.Is(err, ErrEmpty) {
+		t.Errorf("got %v, wanted %v", err, ErrEmpty)
+	}
+
+	// crash between processing and removal
+	if err = Q.Enqueue([]byte("attachment"), WithKey("file-1")); err != nil {
+		t.Fatal(err)
+	}
+	km, err := Q.readKey("file-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.markDone("file-1", km.Item); err != nil {
+		t.Fatal(err)
+	}
+	var kinds []EventKind
+	Q.Observers = append(Q.Observers, func(e Event) { kinds = append(kinds, e.Kind) })
+	if err = Q.Dequeue(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, wanted 1", calls)
+	}
+	if want := fmt.Sprint([]EventKind{EventDiscovered, EventSkipped}); fmt.Sprint(kinds) != want {
+		t.Errorf("got events %v, wanted %s", kinds, want)
+	}
+
+	Q.KeyRetention = 0
+	if err = Q.PruneKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if dis, _ := os.ReadDir(filepath.Join(Q.Dir, KeysDir)); len(dis) != 0 {
+		t.Errorf("got %d keys after prune", len(dis))
+	}
+}
+
+func TestInspect(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	for _, s := range []string{"a", "b", "c"} {
+		if err = Q.Enqueue([]byte(s), WithGroup("G")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := Q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Meta.Group != "G" {
+		t.Fatalf("got %+v", entries)
+	}
+	if p, _, err := Q.Peek(entries[1].ID); err != nil || string(p) != "b" {
+		t.Errorf("Peek: got %q, %v", p, err)
+	}
+	if err = Q.Kill(entries[0].ID, "by hand"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Remove(entries[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	st, err := Q.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Count != 1 || st.Dead != 1 || st.Oldest != entries[2].Enqueued || st.OldestDue != entries[2].Enqueued {
+		t.Errorf("got %+v", st)
+	}
+	// A delayed item is not due.
+	m := entries[2].Meta
+	m.NextAttempt = time.Now().Add(time.Hour)
+	if err = Q.writeMeta(".", entries[2].ID+ext, m); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = Q.Stats(); err != nil {
+		t.Fatal(err)
+	}
+	if st.Oldest != entries[2].Enqueued || !st.OldestDue.IsZero() {
+		t.Errorf("delayed: got %+v", st)
+	}
+	if err = Q.Retry(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if e, err := Q.Find(entries[0].ID); err != nil || e.Dead || e.Meta.Group != "G" {
+		t.Errorf("retried: got %+v, %v", e, err)
+	}
+	if n, err := Q.Purge(false); err != nil || n != 2 {
+		t.Errorf("Purge: got %d, %v", n, err)
+	}
+	if _, err = Q.Find(entries[0].ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, wanted %v", err, ErrNotFound)
+	}
+}
+
+func TestWatchPoll(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	before := time.Now().Add(-time.Second)
+	if err = Q.Enqueue([]byte("missed")); err != nil {
+		t.Fatal(err)
+	}
+	if !Q.missedEvents(before, 0) {
+		t.Error("missed event not detected")
+	}
+	if Q.missedEvents(before, time.Hour) {
+		t.Error("missed event detected within grace")
+	}
+	if Q.missedEvents(time.Now().Add(time.Second), 0) {
+		t.Error("missed event detected for an older item")
+	}
+
+	Q.PollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan string, 1)
+	f := func(_ context.Context, p []byte) error {
+		select {
+		case done <- string(p):
+		default:
+		}
+		return nil
+	}
+	watchDone := make(chan struct{})
+	defer func() { cancel(); <-watchDone }()
+	go func() {
+		defer close(watchDone)
+		_ = Q.Watch(ctx, f)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err = Q.Enqueue([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-done:
+		if s != "missed" && s != "new" {
+			t.Errorf("got %q", s)
+		}
+	case <-ctx.Done():
+		t.Fatal("item has not been processed")
+	}
+}
+
+// countStorage counts the listings of the queue directory.
+type countStorage struct {
+	Storage
+	readDirs atomic.Int64
+}
+
+func (cs *countStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == "." {
+		cs.readDirs.Add(1)
+	}
+	return cs.Storage.ReadDir(name)
+}
+
+func TestWatchRemovedDelayed(t *testing.T) {
+	st := &countStorage{Storage: NewMemStorage()}
+	Q, err := Open(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.PollInterval = time.Hour
+	if err = Q.EnqueueAt(time.Now().Add(100*time.Millisecond), []byte("later")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	watchDone := make(chan struct{})
+	defer func() { cancel(); <-watchDone }()
+	go func() {
+		defer close(watchDone)
+		_ = Q.Watch(ctx, func(context.Context, []byte) error {
+			t.Error("the removed item has been processed")
+			return nil
+		})
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if Q.NextDue().IsZero() {
+		t.Fatal("the delayed item has not been seen")
+	}
+	entries, err := Q.List()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %+v (%+v)", entries, err)
+	}
+	// The only delayed item is gone before it becomes due.
+	if err = Q.Remove(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	st.readDirs.Store(0)
+	time.Sleep(300 * time.Millisecond)
+	if n := st.readDirs.Load(); n > 5 {
+		t.Errorf("Watch spins: %d listings", n)
+	}
+	if next := Q.NextDue(); !next.IsZero() {
+		t.Errorf("stale next due %s", next)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.MaxItems = 2
+	for i := range 2 {
+		if err = Q.Enqueue([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = Q.Enqueue([]byte("third")); !errors.Is(err, ErrFull) {
+		t.Errorf("MaxItems: got %v, wanted ErrFull", err)
+	}
+
+	Q.MaxItems, Q.MaxBytes = 0, 1024
+	if _, err = Q.PutBlob(bytes.NewReader(make([]byte, 2048))); !errors.Is(err, ErrFull) {
+		t.Errorf("MaxBytes blob: got %v, wanted ErrFull", err)
+	}
+	if _, err = Q.PutBlob(strings.NewReader("small")); err != nil {
+		t.Errorf("small blob: %+v", err)
+	}
+	if err = Q.Enqueue(bytes.Repeat([]byte{'a'}, 1024)); !errors.Is(err, ErrFull) {
+		t.Errorf("MaxBytes: got %v, wanted ErrFull", err)
+	}
+	items, size, err := Q.Usage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items != 2 || size >= Q.MaxBytes {
+		t.Errorf("Usage: got %d items, %d bytes", items, size)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.Archive = true
+	hsh, err := Q.PutBlob(strings.NewReader("attachment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Enqueue([]byte("archived"), WithBlobs(hsh)); err != nil {
+		t.Fatal(err)
+	}
+	var id string
+	if err = Q.Dequeue(ctx, func(ctx context.Context, p []byte) error {
+		id = ItemID(ctx)
+		SetResult(ctx, []byte(`{"CommentID":"1"}`))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(Q.Dir, DoneDir, time.Now().Format(doneDateFormat))
+	if b, err := os.ReadFile(filepath.Join(dir, id+ext)); err != nil {
+		t.Fatal(err)
+	} else if b, err = decode(b); err != nil || string(b) != "archived" {
+		t.Errorf("got %q (%v)", b, err)
+	}
+	m, err := Q.readMetaFile(path.Join(DoneDir, time.Now().Format(doneDateFormat), id+metaExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The archive counts in the quota.
+	fi, err := os.Stat(filepath.Join(Q.Dir, BlobDir, hsh))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items, size, err := Q.Usage(); err != nil || items != 0 || size <= fi.Size() {
+		t.Errorf("Usage: got %d items, %d bytes (blob %d): %+v", items, size, fi.Size(), err)
+	}
+	if m.Done.IsZero() || string(m.Result) != `{"CommentID":"1"}` {
+		t.Errorf("got meta %+v", m)
+	}
+	if err = Q.GCBlobs(0); err != nil {
+		t.Fatal(err)
+	}
+	if fh, err := Q.OpenBlob(hsh); err != nil {
+		t.Errorf("archived blob: %+v", err)
+	} else {
+		fh.Close()
+	}
+
+	if err = Q.PruneDone(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(dir); err != nil {
+		t.Errorf("recent archive pruned: %v", err)
+	}
+	old := filepath.Join(Q.Dir, DoneDir, time.Now().AddDate(0, 0, -3).Format(doneDateFormat))
+	if err = os.MkdirAll(old, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.PruneDone(24 * time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("old archive: got %v, wanted not exist", err)
+	}
+}
+
+// faultStorage fails the renames and removals of the matching files.
+type faultStorage struct {
+	Storage
+	mu   sync.Mutex
+	fail func(op, name string) bool
+}
+
+func (fs *faultStorage) failed(op, name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.fail != nil && fs.fail(op, name) {
+		return fmt.Errorf("%s %s: injected failure", op, name)
+	}
+	return nil
+}
+
+func (fs *faultStorage) Rename(oldname, newname string) error {
+	if err := fs.failed("rename", newname); err != nil {
+		return err
+	}
+	return fs.Storage.Rename(oldname, newname)
+}
+
+func (fs *faultStorage) Remove(name string) error {
+	if err := fs.failed("remove", name); err != nil {
+		return err
+	}
+	return fs.Storage.Remove(name)
+}
+
+func TestArchiveFailure(t *testing.T) {
+	ctx := context.Background()
+	st := &faultStorage{Storage: NewMemStorage()}
+	Q, err := Open(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.Archive = true
+	Q.LeaseDuration = 50 * time.Millisecond
+	if err = Q.Enqueue([]byte("processed"), WithGroup("A")); err != nil {
+		t.Fatal(err)
+	}
+	// Neither archive, nor remove the processed item.
+	st.fail = func(op, name string) bool {
+		return op == "rename" && strings.HasPrefix(name, DoneDir+"/") ||
+			op == "remove" && strings.HasSuffix(name, ext+".y")
+	}
+	var calls int
+	f := func(context.Context, []byte) error { calls++; return nil }
+	if err = Q.Dequeue(ctx, f); err != nil {
+		t.Fatalf("failed archive: %+v", err)
+	}
+	entries, err := Q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Meta.Done.IsZero() || entries[0].Meta.Attempts != 0 {
+		t.Fatalf("got %+v, wanted a single item marked done", entries)
+	}
+
+	// After the lease has expired, the item is removed, without processing it again.
+	st.mu.Lock()
+	st.fail = nil
+	st.mu.Unlock()
+	time.Sleep(2 * Q.LeaseDuration)
+	if err = Q.Dequeue(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Dequeue(ctx, f); !errors.Is(err, ErrEmpty) {
+		t.Errorf("got %v, wanted %v", err, ErrEmpty)
+	}
+	if calls != 1 {
+		t.Errorf("got %d calls, wanted 1", calls)
+	}
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	Q1, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q1.Close()
+	// A second consumer of the same queue.
+	Q2, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q2.Close()
+	for _, s := range []string{"a1", "a2"} {
+		if err = Q1.Enqueue([]byte(s), WithGroup("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Q2 must not overtake the group being processed by Q1.
+	started, proceed := make(chan struct{}), make(chan struct{})
+	var got1 []string
+	done := make(chan error, 1)
+	go func() {
+		done <- Q1.Dequeue(ctx, func(_ context.Context, p []byte) error {
+			if string(p) == "a1" {
+				close(started)
+				<-proceed
+			}
+			got1 = append(got1, string(p))
+			return nil
+		})
+	}()
+	<-started
+	entries, err := Q2.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entries[0].InFlight || entries[0].Lease.Owner != Q1.owner || entries[0].Lease.Expired(time.Now()) {
+		t.Errorf("got %+v, wanted in-flight with the lease of %s", entries[0], Q1.owner)
+	}
+	if err = Q2.Dequeue(ctx, func(_ context.Context, p []byte) error {
+		t.Errorf("Q2 got %q", p)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	close(proceed)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(got1) != 2 {
+		t.Errorf("Q1 got %q", got1)
+	}
+
+	// A crashed consumer's item becomes visible again after its lease expires.
+	Q1.LeaseDuration = 10 * time.Millisecond
+	if err = Q1.Enqueue([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err = Q1.List()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %+v (%+v)", entries, err)
+	}
+	if err = Q1.claim(entries[0].ID + ext); err != nil {
+		t.Fatal(err)
+	}
+	var got2 []string
+	f2 := func(_ context.Context, p []byte) error {
+		got2 = append(got2, string(p))
+		return nil
+	}
+	if err = Q2.Dequeue(ctx, f2); !errors.Is(err, ErrEmpty) || len(got2) != 0 {
+		t.Fatalf("leased: got %q (%+v)", got2, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err = Q2.Dequeue(ctx, f2); err != nil {
+		t.Fatal(err)
+	}
+	if len(got2) != 1 || got2[0] != "b" {
+		t.Errorf("expired: got %q", got2)
+	}
+
+	// An in-flight item without a lease gets one.
+	Q2.LeaseDuration = 10 * time.Millisecond
+	if err = Q1.Enqueue([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = Q1.List(); err != nil || len(entries) != 1 {
+		t.Fatalf("got %+v (%+v)", entries, err)
+	}
+	if err = os.Rename(filepath.Join(dir, entries[0].ID+ext), filepath.Join(dir, entries[0].ID+ext+".y")); err != nil {
+		t.Fatal(err)
+	}
+	got2 = got2[:0]
+	if err = Q2.Dequeue(ctx, f2); !errors.Is(err, ErrEmpty) || len(got2) != 0 {
+		t.Fatalf("unleased: got %q (%+v)", got2, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if err = Q2.Dequeue(ctx, f2); err != nil {
+		t.Fatal(err)
+	}
+	if len(got2) != 1 || got2[0] != "c" {
+		t.Errorf("ownerless: got %q", got2)
+	}
+	if dis, _ := os.ReadDir(dir); len(dis) != 0 {
+		var names []string
+		for _, di := range dis {
+			names = append(names, di.Name())
+		}
+		t.Errorf("remained: %q", names)
+	}
+}
+
+// hookStorage calls afterRename after each rename.
+type hookStorage struct {
+	Storage
+	afterRename func(oldname, newname string)
+}
+
+func (hs *hookStorage) Rename(oldname, newname string) error {
+	err := hs.Storage.Rename(oldname, newname)
+	if err == nil && hs.afterRename != nil {
+		hs.afterRename(oldname, newname)
+	}
+	return err
+}
+
+func TestBreakLeaseClaimed(t *testing.T) {
+	st := &hookStorage{Storage: NewMemStorage()}
+	Q1, err := Open(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q1.Close()
+	Q2, err := Open(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Q1.Enqueue([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := Q1.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm := entries[0].ID + ext
+	// The item of a crashed consumer, with an expired lease.
+	if err = Q1.claim(nm); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(Lease{Owner: "crashed", Expires: time.Now().Add(-time.Minute)})
+	if err = Q1.writeFile(leaseName(entries[0].ID), b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Q2 claims the item as soon as it is pending again.
+	st.afterRename = func(oldname, newname string) {
+		if oldname == nm+".y" && newname == nm {
+			st.afterRename = nil
+			if err := Q2.claim(nm); err != nil {
+				t.Errorf("Q2 claim: %+v", err)
+			}
+		}
+	}
+	if !Q1.breakLease(nm+".y", time.Now()) {
+		t.Fatal("lease not broken")
+	}
+	if l, err := Q1.readLease(entries[0].ID); err != nil || l.Owner != Q2.owner {
+		t.Errorf("got lease %+v (%+v), wanted the lease of %s", l, err, Q2.owner)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	for _, s := range []string{"A1", "A2", "A3", "A4"} {
+		if err = Q.Enqueue([]byte(s), WithGroup("A")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := Q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flip a bit of A1.
+	fn := filepath.Join(Q.Dir, entries[0].ID+ext)
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 1
+	if err = os.WriteFile(fn, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A2 has been written by an earlier version, without checksum.
+	fn = filepath.Join(Q.Dir, entries[1].ID+ext)
+	if b, err = os.ReadFile(fn); err != nil {
+		t.Fatal(err)
+	}
+	b[len(magic)] = 1
+	if err = os.WriteFile(fn, append(b[:v1HeaderLen:v1HeaderLen], b[headerLen:]...), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	f := func(_ context.Context, p []byte) error {
+		if string(p) == "A3" {
+			return fmt.Errorf("%w: %w", ErrCorrupt, errors.New("undecodable"))
+		}
+		got = append(got, string(p))
+		return nil
+	}
+	var qErr *QuarantineError
+	if err = Q.Dequeue(ctx, f); !errors.As(err, &qErr) {
+		t.Fatalf("got %v, wanted QuarantineError", err)
+	}
+	if want := "[A2 A4]"; fmt.Sprintf("%v", got) != want {
+		t.Errorf("got %v, wanted %s", got, want)
+	}
+	quarantined, err := Q.ListQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 2 || quarantined[0].ID != entries[0].ID || quarantined[1].ID != entries[2].ID {
+		t.Fatalf("got %+v quarantined, wanted A1 and A3", quarantined)
+	}
+	if quarantined[0].Meta.Quarantined.IsZero() || quarantined[0].Meta.LastError == "" {
+		t.Errorf("got meta %+v", quarantined[0].Meta)
+	}
+	if st, err := Q.Stats(); err != nil {
+		t.Fatal(err)
+	} else if st.Count != 0 || st.Quarantined != 2 {
+		t.Errorf("got %+v, wanted 0 pending, 2 quarantined", st)
+	}
+
+	// A3 is not corrupt, just undecodable by f: retry moves it back.
+	if err = Q.Retry(entries[2].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Dequeue(ctx, func(_ context.Context, p []byte) error {
+		got = append(got, string(p))
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[A2 A4 A3]"; fmt.Sprintf("%v", got) != want {
+		t.Errorf("got %v, wanted %s", got, want)
+	}
+
+	// A corrupt blob fails at EOF.
+	hsh, err := Q.PutBlob(strings.NewReader("blob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(Q.Dir, BlobDir, hsh), []byte("blub"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := Q.OpenBlob(hsh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if _, err = io.ReadAll(fh); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("read corrupt blob: got %v, wanted %v", err, ErrCorrupt)
+	}
+}
+
+func TestEnqueueAt(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	at := time.Now().Add(time.Hour)
+	if err = Q.EnqueueAt(at, []byte("A1"), WithGroup("A")); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Enqueue([]byte("A2"), WithGroup("A")); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.EnqueueAt(time.Now().Add(-time.Second), []byte("B1"), WithGroup("B")); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	f := func(_ context.Context, p []byte) error {
+		got = append(got, string(p))
+		return nil
+	}
+	if err = Q.Dequeue(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	// The scheduled A1 does not block A2.
+	if want := "[A2 B1]"; fmt.Sprintf("%v", got) != want {
+		t.Errorf("got %v, wanted %s", got, want)
+	}
+	if next := Q.NextDue(); !next.Equal(at) {
+		t.Errorf("got next due %v, wanted %v", next, at)
+	}
+	entries, err := Q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Meta.Due(time.Now()) || !entries[0].Meta.Due(at) {
+		t.Fatalf("got %+v, wanted the scheduled A1", entries)
+	}
+	// Retry makes it due now.
+	if err = Q.Retry(entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Dequeue(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	if want := "[A2 B1 A1]"; fmt.Sprintf("%v", got) != want {
+		t.Errorf("got %v, wanted %s", got, want)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	ctx := context.Background()
+	Q, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	Q.Backoff = func(int) time.Duration { return 0 }
+	var events []string
+	Q.Observers = append(Q.Observers, func(e Event) {
+		if e.ID == "" || e.Time.IsZero() {
+			t.Errorf("bad event %+v", e)
+		}
+		if (e.Kind == EventEnqueued || e.Kind == EventDequeued) && e.Size != 2 {
+			t.Errorf("%s: got size %d, wanted 2", e.Kind, e.Size)
+		}
+		events = append(events, fmt.Sprintf("%s:%s:%d", e.Group, e.Kind, e.Attempts))
+	})
+	for _, s := range []string{"A1", "B1"} {
+		if err = Q.Enqueue([]byte(s), WithGroup(s[:1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := func(_ context.Context, p []byte) error {
+		switch string(p) {
+		case "A1":
+			return errors.New("fail once")
+		case "B1":
+			return fmt.Errorf("%w: bad", ErrPermanent)
+		}
+		return nil
+	}
+	if err = Q.Dequeue(ctx, f); err == nil {
+		t.Fatal("wanted error")
+	}
+	if err = Q.Dequeue(ctx, func(context.Context, []byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	want := "[A:enqueued:0 B:enqueued:0 A:discovered:0 B:discovered:0 A:dequeued:0 A:failed:1 B:dequeued:0 B:dead-lettered:1 A:dequeued:1 A:succeeded:1]"
+	if got := fmt.Sprintf("%v", events); got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+}
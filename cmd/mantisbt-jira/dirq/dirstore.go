@@ -0,0 +1,66 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/google/renameio/v2"
+)
+
+// dirStorage is the directory storage: one file per item, metadata, blob and key.
+type dirStorage struct {
+	root string
+}
+
+// NewDirStorage returns the storage using the files of dir.
+func NewDirStorage(dir string) Storage { return &dirStorage{root: dir} }
+
+func (ds *dirStorage) Dir() string { return ds.root }
+
+func (ds *dirStorage) path(name string) string {
+	return filepath.Join(ds.root, filepath.FromSlash(name))
+}
+
+func (ds *dirStorage) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(ds.path(name)) }
+func (ds *dirStorage) Open(name string) (fs.File, error)          { return os.Open(ds.path(name)) }
+func (ds *dirStorage) ReadFile(name string) ([]byte, error)       { return os.ReadFile(ds.path(name)) }
+func (ds *dirStorage) Stat(name string) (fs.FileInfo, error)      { return os.Lstat(ds.path(name)) }
+func (ds *dirStorage) Remove(name string) error                   { return os.Remove(ds.path(name)) }
+func (ds *dirStorage) RemoveAll(name string) error                { return os.RemoveAll(ds.path(name)) }
+func (ds *dirStorage) Rename(oldname, newname string) error {
+	return os.Rename(ds.path(oldname), ds.path(newname))
+}
+func (ds *dirStorage) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(ds.path(name), perm)
+}
+
+func (ds *dirStorage) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	t, err := renameio.NewPendingFile(ds.path(name),
+		renameio.WithPermissions(perm), renameio.WithExistingPermissions())
+	if err != nil {
+		return err
+	}
+	defer t.Cleanup()
+	if _, err = io.Copy(t, r); err != nil {
+		return err
+	}
+	return t.CloseAtomicallyReplace()
+}
+
+func (ds *dirStorage) CreateFile(name string, data []byte, perm fs.FileMode) error {
+	fh, err := os.OpenFile(ds.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = fh.Write(data)
+	if closeErr := fh.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (ds *dirStorage) Close() error { return nil }
@@ -0,0 +1,210 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"archive/tar"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+)
+
+// paxMeta is the PAX record of the exported item holding its metadata,
+// paxSealedMeta holds it base64-encoded, if it is encrypted.
+const (
+	paxMeta       = "DIRQ.meta"
+	paxSealedMeta = "DIRQ.meta.sealed"
+)
+
+// Export writes the items of the queue (pending, dead and quarantined),
+// with their metadata and the blobs they reference, into tw, under the prefix directory.
+//
+// The in-flight items are being processed, so they are skipped - unless inFlight is true,
+// when they are exported as pending (and may be processed twice).
+//
+// The items are written as they are stored (encrypted, if they are),
+// the archive, the leases and the idempotency keys are not exported.
+//
+// Returns the number of the exported items.
+func (Q *Queue) Export(tw *tar.Writer, prefix string, inFlight bool) (int, error) {
+	pending, err := Q.List()
+	if err != nil {
+		return 0, err
+	}
+	entries := pending[:0]
+	for _, e := range pending {
+		if e.InFlight && !inFlight {
+			slog.Warn("export skips in-flight item", "id", e.ID, "owner", e.Lease.Owner)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	dead, err := Q.ListDead()
+	if err != nil {
+		return 0, err
+	}
+	quarantined, err := Q.ListQuarantined()
+	if err != nil {
+		return 0, err
+	}
+	entries = append(append(entries, dead...), quarantined...)
+
+	// The blobs first, to be there when the items appear.
+	var blobs []string
+	for _, e := range entries {
+		blobs = append(blobs, e.Meta.Blobs...)
+	}
+	slices.Sort(blobs)
+	for _, hsh := range slices.Compact(blobs) {
+		if err := Q.exportBlob(tw, prefix, hsh); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	for _, e := range entries {
+		b, err := Q.st.ReadFile(Q.path(e))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) { // processed meanwhile
+				continue
+			}
+			return n, err
+		}
+		hdr := tar.Header{
+			Typeflag: tar.TypeReg, Format: tar.FormatPAX,
+			Name: path.Join(prefix, e.dir(), e.ID+ext),
+			Mode: 0400, Size: int64(len(b)), ModTime: e.Enqueued,
+		}
+		if mb, err := Q.st.ReadFile(Q.metaPath(e)); err == nil && IsSealed(mb) {
+			hdr.PAXRecords = map[string]string{paxSealedMeta: base64.StdEncoding.EncodeToString(mb)}
+		} else if err == nil {
+			hdr.PAXRecords = map[string]string{paxMeta: string(mb)}
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return n, err
+		}
+		if err = tw.WriteHeader(&hdr); err != nil {
+			return n, err
+		}
+		if _, err = tw.Write(b); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func (Q *Queue) exportBlob(tw *tar.Writer, prefix, hsh string) error {
+	fh, err := Q.st.Open(path.Join(BlobDir, hsh))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer fh.Close()
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg, Format: tar.FormatPAX,
+		Name: path.Join(prefix, BlobDir, hsh),
+		Mode: 0400, Size: fi.Size(), ModTime: fi.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, fh)
+	return err
+}
+
+// Import imports a file of an archive written by Export into the queue,
+// name being its name relative to the prefix of the export.
+//
+// The imported items keep their IDs, thus their order among the items of the queue.
+// Existing items (and duplicates by idempotency key) are skipped.
+//
+// Reports whether the file has been imported.
+func (Q *Queue) Import(name string, hdr *tar.Header, r io.Reader) (bool, error) {
+	dir, nm := path.Split(name)
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == BlobDir {
+		if !isBlobName(nm) {
+			return false, fmt.Errorf("%q: %w", name, ErrBadBlob)
+		}
+		fn := path.Join(BlobDir, nm)
+		if _, err := Q.st.Stat(fn); err == nil {
+			return false, nil
+		}
+		if err := Q.st.MkdirAll(BlobDir, 0750); err != nil {
+			return false, err
+		}
+		return true, Q.st.WriteFile(fn, r, 0400)
+	}
+	if !(dir == "" || dir == DeadDir || dir == QuarantineDir) || len(nm) != 26+len(ext) || !strings.HasSuffix(nm, ext) {
+		return false, fmt.Errorf("%q: not an item", name)
+	}
+	if Q.hasItem(nm) {
+		return false, nil
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	var m Meta
+	mb := []byte(hdr.PAXRecords[paxMeta])
+	if s := hdr.PAXRecords[paxSealedMeta]; s != "" {
+		if mb, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if len(mb) != 0 {
+		if m, err = Q.decodeMeta(mb); err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	if m.Key != "" {
+		if dup, err := Q.reserveKey(m.Key, nm); err != nil {
+			return false, err
+		} else if dup {
+			return false, nil
+		}
+	}
+	if dir != "" {
+		if err = Q.st.MkdirAll(dir, 0750); err != nil {
+			return false, err
+		}
+		if len(mb) != 0 {
+			if err = Q.writeMeta(dir, nm, m); err != nil {
+				return false, err
+			}
+		}
+		return true, Q.writeFile(path.Join(dir, nm), b, 0400)
+	}
+
+	// Write the item as in-flight (under our lease) and release it,
+	// to not to have its metadata removed as orphan meanwhile.
+	id := nm[:26]
+	if err = Q.writeLease(id, Q.owner, true); err != nil {
+		return false, err
+	}
+	if len(mb) != 0 {
+		if err = Q.writeMeta(".", nm, m); err != nil {
+			_ = Q.removeFile(leaseName(id))
+			Q.releaseKey(m.Key)
+			return false, err
+		}
+	}
+	if err = Q.writeFile(nm+".y", b, 0400); err != nil {
+		_ = Q.removeFile(leaseName(id))
+		Q.releaseKey(m.Key)
+		return false, err
+	}
+	Q.release(nm)
+	return true, nil
+}
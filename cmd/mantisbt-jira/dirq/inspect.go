@@ -0,0 +1,365 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// Entry describes an item of the queue.
+type Entry struct {
+	// Enqueued is the time of the enqueue (from the ID).
+	Enqueued time.Time
+	// ID is the ULID of the item.
+	ID   string
+	Meta Meta
+	Size int64
+	// Lease is the lease of the consumer processing the in-flight item.
+	Lease Lease
+	// InFlight is true while the item is being processed.
+	InFlight bool
+	// Dead is true for the items in the dead-letter directory.
+	Dead bool
+	// Quarantined is true for the (corrupt) items in the quarantine directory.
+	Quarantined bool
+}
+
+// dir is the directory of the entry.
+func (e Entry) dir() string {
+	if e.Dead {
+		return DeadDir
+	} else if e.Quarantined {
+		return QuarantineDir
+	}
+	return "."
+}
+
+// Stats is a summary of the queue.
+type Stats struct {
+	// Oldest is the enqueue time of the oldest pending item.
+	Oldest time.Time
+	// OldestDue is the time the oldest due (not in-flight, not delayed) item waits since:
+	// its enqueue, or its scheduled time (see EnqueueAt) - the delivery lag.
+	OldestDue time.Time
+	// Count is the number of pending items (including the in-flight ones).
+	Count       int
+	InFlight    int
+	Dead        int
+	Quarantined int
+	// Bytes is the size of the pending items.
+	Bytes int64
+}
+
+var (
+	// ErrNotFound is returned when no item exists with the given ID.
+	ErrNotFound = errors.New("item not found")
+	// ErrInFlight is returned when the item is being processed.
+	ErrInFlight = errors.New("item is in flight")
+)
+
+// List the items of the queue (pending and in-flight), in order.
+func (Q *Queue) List() ([]Entry, error) { return Q.list(".") }
+
+// ListDead lists the items of the dead-letter directory, in order.
+func (Q *Queue) ListDead() ([]Entry, error) { return Q.list(DeadDir) }
+
+func (Q *Queue) list(dir string) ([]Entry, error) {
+	dis, err := Q.readDir(dir)
+	if len(dis) == 0 {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(dis))
+	for _, di := range dis {
+		nm := di.Name()
+		if !di.Type().IsRegular() || len(nm) < 26 {
+			continue
+		}
+		e := Entry{ID: nm[:26], Dead: dir == DeadDir, Quarantined: dir == QuarantineDir}
+		switch nm[26:] {
+		case ext:
+		case ext + ".y":
+			e.InFlight = true
+		default:
+			continue
+		}
+		id, err := ulid.ParseStrict(e.ID)
+		if err != nil {
+			continue
+		}
+		e.Enqueued = ulid.Time(id.Time())
+		if fi, err := di.Info(); err == nil {
+			e.Size = fi.Size()
+		}
+		if e.Meta, err = Q.readMetaFile(path.Join(dir, e.ID+metaExt)); err != nil {
+			if !errors.Is(err, ErrNoKey) {
+				return entries, fmt.Errorf("%s: %w", e.ID, err)
+			}
+			// Listed without its metadata till its key is added.
+			slog.Warn("readMeta", "id", e.ID, "error", err)
+		}
+		if e.InFlight && dir == "." {
+			if e.Lease, err = Q.readLease(e.ID); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return entries, fmt.Errorf("%s: %w", e.ID, err)
+			}
+		}
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.ID, b.ID) })
+	return entries, nil
+}
+
+// Stats returns the summary of the queue.
+func (Q *Queue) Stats() (Stats, error) {
+	var st Stats
+	entries, err := Q.List()
+	if err != nil {
+		return st, err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if st.Count == 0 {
+			st.Oldest = e.Enqueued
+		}
+		st.Count++
+		st.Bytes += e.Size
+		if e.InFlight {
+			st.InFlight++
+		} else if e.Meta.Due(now) {
+			since := e.Enqueued
+			if e.Meta.NotBefore.After(since) {
+				since = e.Meta.NotBefore
+			}
+			if st.OldestDue.IsZero() || since.Before(st.OldestDue) {
+				st.OldestDue = since
+			}
+		}
+	}
+	dead, err := Q.ListDead()
+	st.Dead = len(dead)
+	if err != nil {
+		return st, err
+	}
+	quarantined, err := Q.ListQuarantined()
+	st.Quarantined = len(quarantined)
+	return st, err
+}
+
+// Find the item by its ID, in the queue, in the dead-letter or in the quarantine directory.
+func (Q *Queue) Find(id string) (Entry, error) {
+	for _, dir := range []string{".", DeadDir, QuarantineDir} {
+		entries, err := Q.list(dir)
+		if err != nil {
+			return Entry{}, err
+		}
+		for _, e := range entries {
+			if e.ID == id {
+				return e, nil
+			}
+		}
+	}
+	return Entry{}, fmt.Errorf("%s: %w", id, ErrNotFound)
+}
+
+// path of the entry's file.
+func (Q *Queue) path(e Entry) string {
+	nm := e.ID + ext
+	if e.InFlight {
+		nm += ".y"
+	}
+	return path.Join(e.dir(), nm)
+}
+
+// metaPath is the path of the entry's metadata.
+func (Q *Queue) metaPath(e Entry) string { return path.Join(e.dir(), e.ID+metaExt) }
+
+// Peek returns the payload of the item, without dequeueing it.
+func (Q *Queue) Peek(id string) ([]byte, Entry, error) {
+	e, err := Q.Find(id)
+	if err != nil {
+		return nil, e, err
+	}
+	b, err := Q.Read(e)
+	return b, e, err
+}
+
+// Read returns the payload of the listed entry.
+func (Q *Queue) Read(e Entry) ([]byte, error) {
+	b, err := Q.st.ReadFile(Q.path(e))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = fmt.Errorf("%s: %w", e.ID, ErrNotFound)
+		}
+		return nil, err
+	}
+	return Q.decode(b)
+}
+
+// Retry makes the item due immediately, resetting its attempts.
+// A dead or quarantined item is moved back to the queue.
+func (Q *Queue) Retry(id string) error {
+	e, err := Q.Find(id)
+	if err != nil {
+		return err
+	}
+	if e.InFlight {
+		return fmt.Errorf("%s: %w", id, ErrInFlight)
+	}
+	m := e.Meta
+	m.Attempts, m.NextAttempt, m.NotBefore = 0, time.Time{}, time.Time{}
+	m.Dead, m.Quarantined = time.Time{}, time.Time{}
+	m.FirstFailure, m.LastFailure, m.LastError = time.Time{}, time.Time{}, ""
+	nm := e.ID + ext
+	if err = Q.writeMeta(".", nm, m); err != nil {
+		return err
+	}
+	if !e.Dead && !e.Quarantined {
+		return nil
+	}
+	if err = Q.st.Rename(Q.path(e), nm); err != nil {
+		return err
+	}
+	return Q.removeFile(Q.metaPath(e))
+}
+
+// Remove the item (from the queue, from the dead-letter or from the quarantine directory).
+func (Q *Queue) Remove(id string) error {
+	e, err := Q.Find(id)
+	if err != nil {
+		return err
+	}
+	if e.InFlight {
+		return fmt.Errorf("%s: %w", id, ErrInFlight)
+	}
+	if err = Q.st.Remove(Q.path(e)); err != nil {
+		return err
+	}
+	return Q.removeFile(Q.metaPath(e))
+}
+
+// Kill moves the item into the dead-letter directory, with the given reason.
+func (Q *Queue) Kill(id, reason string) error {
+	e, err := Q.Find(id)
+	if err != nil {
+		return err
+	}
+	if e.Dead {
+		return nil
+	}
+	if e.InFlight {
+		return fmt.Errorf("%s: %w", id, ErrInFlight)
+	}
+	m := e.Meta
+	m.Dead, m.LastError, m.NextAttempt = time.Now(), reason, time.Time{}
+	if !e.Quarantined {
+		return Q.bury(e.ID+ext, m)
+	}
+	if err = Q.writeMeta(DeadDir, e.ID+ext, m); err != nil {
+		return err
+	}
+	if err = Q.st.Rename(Q.path(e), path.Join(DeadDir, e.ID+ext)); err != nil {
+		return err
+	}
+	return Q.removeFile(Q.metaPath(e))
+}
+
+// Purge removes all the pending (not in-flight) items of the queue,
+// or all the items of the dead-letter directory.
+//
+// Returns the number of the removed items.
+func (Q *Queue) Purge(dead bool) (int, error) {
+	dir := "."
+	if dead {
+		dir = DeadDir
+	}
+	entries, err := Q.list(dir)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	var errs []error
+	for _, e := range entries {
+		if e.InFlight {
+			continue
+		}
+		if err := Q.st.Remove(Q.path(e)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n++
+		if err := Q.removeFile(Q.metaPath(e)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+// Rewrite the payloads of the pending and dead items with f,
+// which returns nil if the payload need not be changed.
+// The pending items are claimed while rewritten, the in-flight ones are skipped.
+//
+// Returns the number of the rewritten items.
+func (Q *Queue) Rewrite(f func(p []byte) ([]byte, error)) (int, error) {
+	var n int
+	var errs []error
+	rewrite := func(name string) {
+		b, err := Q.st.ReadFile(name)
+		if err == nil {
+			b, err = Q.decode(b)
+		}
+		if err == nil {
+			b, err = f(b)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			return
+		}
+		if b == nil {
+			return
+		}
+		b = encode(b, Q.CompressThreshold)
+		if Q.Keys != nil {
+			b = Q.Keys.Seal(b)
+		}
+		if err = Q.writeFile(name, b, 0400); err != nil {
+			errs = append(errs, err)
+			return
+		}
+		n++
+	}
+	entries, err := Q.List()
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.InFlight {
+			continue
+		}
+		// Claim the pending item, to not to overwrite it under a consumer.
+		nm := e.ID + ext
+		if err := Q.claim(nm); err != nil {
+			if !errors.Is(err, errClaimed) {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		rewrite(nm + ".y")
+		Q.release(nm)
+	}
+	dead, err := Q.ListDead()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, e := range dead {
+		rewrite(Q.path(e))
+	}
+	return n, errors.Join(errs...)
+}
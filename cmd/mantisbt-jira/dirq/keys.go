@@ -0,0 +1,212 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path"
+	"time"
+)
+
+// KeysDir is the name of the idempotency keys' subdirectory of the queue.
+const KeysDir = "keys"
+
+// DefaultKeyRetention is the default time an idempotency key is kept
+// after its message has been processed.
+const DefaultKeyRetention = 24 * time.Hour
+
+// WithKey sets the idempotency key of the message:
+// enqueueing a message with the same key is a no-op
+// while the message is in the queue, and for KeyRetention after its processing.
+//
+// A processed message won't be processed again, even if the removal of
+// its file has been interrupted by a crash.
+func WithKey(key string) Option { return func(m *Meta) { m.Key = key } }
+
+// keyMark is the contents of a key file.
+//
+// The Key is recorded only without Keys - with Keys, the key file is named
+// by the keyed hash of the key, and does not contain it.
+type keyMark struct {
+	Enqueued time.Time
+	Done     time.Time
+	Key      string `json:",omitempty"`
+	Item     string
+}
+
+func (Q *Queue) keyPath(key string) string { return Q.keyPaths(key)[0] }
+
+// keyPaths returns the possible names of the key file: the keyed hashes
+// of the key with all the keys of Keys (the current one first), and its plain hash.
+func (Q *Queue) keyPaths(key string) []string {
+	hs := append(Q.Keys.nameHashes(), sha256.New())
+	fns := make([]string, len(hs))
+	for i, h := range hs {
+		h.Write([]byte(key))
+		fns[i] = path.Join(KeysDir, hex.EncodeToString(h.Sum(nil)))
+	}
+	return fns
+}
+
+// readKey reads the key mark, from the first existing key file (see keyPaths).
+func (Q *Queue) readKey(key string) (keyMark, error) {
+	var err error
+	for _, fn := range Q.keyPaths(key) {
+		var km keyMark
+		if km, err = Q.readKeyFile(fn); !errors.Is(err, fs.ErrNotExist) {
+			return km, err
+		}
+	}
+	return keyMark{}, err
+}
+
+func (Q *Queue) readKeyFile(fn string) (keyMark, error) {
+	var km keyMark
+	b, err := Q.st.ReadFile(fn)
+	if err != nil {
+		return km, err
+	}
+	err = json.Unmarshal(b, &km)
+	return km, err
+}
+
+// expired reports whether the key mark can be forgotten:
+// its item is not in the queue anymore, and the retention has passed.
+func (Q *Queue) expired(km keyMark) bool {
+	if Q.hasItem(km.Item) {
+		return false
+	}
+	last := km.Enqueued
+	if km.Done.After(last) {
+		last = km.Done
+	}
+	return time.Since(last) > Q.KeyRetention
+}
+
+// hasItem reports whether the item is in the queue (pending, in-flight, dead or quarantined).
+func (Q *Queue) hasItem(nm string) bool {
+	for _, fn := range []string{nm, nm + ".y", path.Join(DeadDir, nm), path.Join(QuarantineDir, nm)} {
+		if _, err := Q.st.Stat(fn); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveKey creates the key mark for the item,
+// and reports whether the key is a duplicate.
+func (Q *Queue) reserveKey(key, nm string) (bool, error) {
+	fns := Q.keyPaths(key)
+	fn := fns[0]
+	if err := Q.st.MkdirAll(KeysDir, 0750); err != nil {
+		return false, err
+	}
+	// The key marks written with an old key (or without Keys).
+	for _, fn := range fns[1:] {
+		if km, err := Q.readKeyFile(fn); err == nil && !Q.expired(km) {
+			return true, nil
+		}
+	}
+	km := keyMark{Item: nm, Enqueued: time.Now()}
+	if Q.Keys == nil {
+		km.Key = key
+	}
+	b, err := json.Marshal(km)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < 2; i++ {
+		err := Q.st.CreateFile(fn, b, 0600)
+		if err == nil {
+			return false, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return false, err
+		}
+		km, err := Q.readKeyFile(fn)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			// Possibly being written right now.
+			slog.Warn("readKey", "file", fn, "error", err)
+			return true, nil
+		}
+		if !Q.expired(km) {
+			return true, nil
+		}
+		_ = Q.st.Remove(fn)
+	}
+	return true, nil
+}
+
+// releaseKey removes the key mark of a message that could not be enqueued.
+func (Q *Queue) releaseKey(key string) {
+	if key != "" {
+		_ = Q.st.Remove(Q.keyPath(key))
+	}
+}
+
+// isDone reports whether the item has already been processed:
+// it is marked done in its metadata (see removeDone), or by its idempotency key.
+func (Q *Queue) isDone(it *item) bool {
+	if !it.Done.IsZero() {
+		return true
+	} else if it.Key == "" {
+		return false
+	}
+	km, err := Q.readKey(it.Key)
+	return err == nil && km.Item == it.Name && !km.Done.IsZero()
+}
+
+// markDone records the successful processing of the item.
+func (Q *Queue) markDone(key, nm string) error {
+	km, err := Q.readKey(key)
+	if err != nil {
+		km = keyMark{Key: key, Item: nm}
+	}
+	if Q.Keys != nil {
+		km.Key = ""
+	}
+	km.Done = time.Now()
+	b, err := json.Marshal(km)
+	if err != nil {
+		return err
+	}
+	return Q.writeFile(Q.keyPath(key), b, 0600)
+}
+
+// PruneKeys removes the expired idempotency keys.
+func (Q *Queue) PruneKeys() error {
+	dis, err := Q.readDir(KeysDir)
+	if len(dis) == 0 {
+		return err
+	}
+	var errs []error
+	for _, di := range dis {
+		fn := path.Join(KeysDir, di.Name())
+		b, err := Q.st.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		var km keyMark
+		if err = json.Unmarshal(b, &km); err != nil {
+			// Possibly being written right now.
+			if fi, statErr := di.Info(); statErr != nil || time.Since(fi.ModTime()) < time.Minute {
+				continue
+			}
+			slog.Warn("PruneKeys", "file", fn, "error", err)
+		} else if !Q.expired(km) {
+			continue
+		}
+		if err = Q.removeFile(fn); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
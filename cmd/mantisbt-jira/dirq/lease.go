@@ -0,0 +1,169 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+const leaseExt = ".dirq-lease.json"
+
+// DefaultLeaseDuration is the default LeaseDuration.
+const DefaultLeaseDuration = 5 * time.Minute
+
+// errClaimed is returned by claim when another consumer has taken the item.
+var errClaimed = errors.New("claimed by another consumer")
+
+// Lease is the claim of a consumer on an in-flight item.
+//
+// The consumer renews the lease while it processes the item;
+// an expired lease (of a crashed consumer) is broken by the next Dequeue
+// of any consumer, making the item pending again.
+type Lease struct {
+	Expires time.Time
+	// Owner identifies the consumer (host/pid/ULID).
+	Owner string
+}
+
+// Expired reports whether the lease has expired at now.
+func (l Lease) Expired(now time.Time) bool { return !l.Expires.After(now) }
+
+func newOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s/%d/%s", host, os.Getpid(), ulid.Make())
+}
+
+func leaseName(id string) string { return id + leaseExt }
+
+func (Q *Queue) leaseDuration() time.Duration {
+	if Q.LeaseDuration > 0 {
+		return Q.LeaseDuration
+	}
+	return DefaultLeaseDuration
+}
+
+func (Q *Queue) readLease(id string) (Lease, error) {
+	var l Lease
+	b, err := Q.st.ReadFile(leaseName(id))
+	if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal(b, &l)
+	return l, err
+}
+
+// writeLease (re)writes the lease of the item (by ID), with the owner,
+// expiring after LeaseDuration from now.
+func (Q *Queue) writeLease(id, owner string, excl bool) error {
+	b, err := json.Marshal(Lease{Owner: owner, Expires: time.Now().Add(Q.leaseDuration())})
+	if err != nil {
+		return err
+	}
+	if excl {
+		return Q.st.CreateFile(leaseName(id), b, 0600)
+	}
+	return Q.writeFile(leaseName(id), b, 0600)
+}
+
+// claim the item (by renaming it to in-flight), and take a lease on it.
+//
+// Returns errClaimed if another consumer has been faster.
+func (Q *Queue) claim(nm string) error {
+	if err := Q.st.Rename(nm, nm+".y"); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("%s: %w", nm, errClaimed)
+		}
+		return err
+	}
+	if err := Q.writeLease(nm[:26], Q.owner, false); err != nil {
+		_ = Q.st.Rename(nm+".y", nm)
+		return err
+	}
+	return nil
+}
+
+// release the claimed item: makes it pending again, and removes the lease.
+func (Q *Queue) release(nm string) {
+	if err := Q.st.Rename(nm+".y", nm); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("release", "name", nm, "error", err)
+	}
+	_ = Q.removeFile(leaseName(nm[:26]))
+}
+
+// renew the lease of the claimed item till ctx is done.
+// Calls lost if the item has been taken away (its lease has been broken).
+func (Q *Queue) renew(ctx context.Context, nm string, lost func()) {
+	ticker := time.NewTicker(max(Q.leaseDuration()/3, time.Millisecond))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if l, err := Q.readLease(nm[:26]); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("readLease", "name", nm, "error", err)
+			continue
+		} else if l.Owner != Q.owner {
+			slog.Warn("lease lost", "name", nm, "owner", l.Owner)
+			lost()
+			return
+		}
+		if err := Q.writeLease(nm[:26], Q.owner, false); err != nil {
+			slog.Error("renew lease", "name", nm, "error", err)
+		}
+	}
+}
+
+// breakLease makes the in-flight item (nmy) pending again iff its lease has expired,
+// reporting whether it did.
+//
+// An in-flight item without a lease (its consumer crashed right after the claim)
+// gets an ownerless lease, to expire after LeaseDuration.
+func (Q *Queue) breakLease(nmy string, now time.Time) bool {
+	id := nmy[:26]
+	l, err := Q.readLease(id)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			if err = Q.writeLease(id, "", true); err != nil && !errors.Is(err, fs.ErrExist) {
+				slog.Error("writeLease", "name", nmy, "error", err)
+			}
+		} else {
+			slog.Error("readLease", "name", nmy, "error", err)
+		}
+		return false
+	}
+	if !l.Expired(now) {
+		return false
+	}
+	// Remove the lease before making the item pending, as after that
+	// another consumer may claim the item, with a new lease -
+	// and only if it is still the expired one (not renewed meanwhile).
+	if cur, err := Q.readLease(id); err != nil || cur != l {
+		return false
+	}
+	if err = Q.st.Remove(leaseName(id)); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("remove lease", "name", nmy, "error", err)
+		}
+		return false
+	}
+	nm := nmy[:len(nmy)-2]
+	if err = Q.st.Rename(nmy, nm); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			slog.Error("break lease", "name", nmy, "error", err)
+		}
+		return false
+	}
+	slog.Warn("lease expired", "name", nm, "owner", l.Owner, "expired", l.Expires)
+	return true
+}
@@ -0,0 +1,556 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LogFileName is the name of the log file of the append-log storage.
+const LogFileName = "dirq.log"
+
+// The log is a sequence of records:
+//
+//	length(4) crc32(4) body
+//
+// where body is
+//
+//	op(1) uvarint(len(name)) name args
+//
+// A torn record at the end of the log (written by a crashed process)
+// is ignored, and truncated by the next write.
+// A corrupt record elsewhere is an ErrCorrupt error.
+const (
+	logOpWrite     = byte(iota + 1) // mode(4) mtime(8) data
+	logOpRename                     // uvarint(len(newname)) newname
+	logOpRemove                     //
+	logOpRemoveAll                  //
+	logOpMkdirAll                   // mode(4) mtime(8)
+)
+
+const (
+	logHeaderLen = 8
+	// compactMinGarbage is the garbage size above which the log is compacted,
+	// if at least the half of it is garbage.
+	compactMinGarbage = 1 << 20
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// logStorage is the single file, append-only log storage,
+// for hosts with small inode quotas.
+//
+// Every change is a record appended to the log; the log is compacted
+// when more than half of it is garbage.
+// The processes sharing the log catch up with the records appended by the others
+// at every operation, under flock.
+type logStorage struct {
+	tree    tree
+	fh      *os.File
+	dir     string
+	off     int64
+	garbage int64
+	mu      sync.Mutex
+	noSync  bool
+}
+
+// NewLogStorage returns the append-log storage in dir (see LogFileName).
+func NewLogStorage(dir string) (Storage, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	ls := &logStorage{dir: dir, tree: newTree()}
+	if err := ls.open(); err != nil {
+		return nil, err
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.begin(false); err != nil {
+		ls.fh.Close()
+		return nil, err
+	}
+	ls.end()
+	return ls, nil
+}
+
+func (ls *logStorage) Dir() string  { return ls.dir }
+func (ls *logStorage) path() string { return filepath.Join(ls.dir, LogFileName) }
+
+func (ls *logStorage) open() error {
+	fh, err := os.OpenFile(ls.path(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	ls.fh, ls.off, ls.garbage, ls.tree = fh, 0, 0, newTree()
+	return nil
+}
+
+// begin locks the log (exclusively iff excl), and catches up with its changes.
+//
+// Must be called with ls.mu held.
+func (ls *logStorage) begin(excl bool) error {
+	how := syscall.LOCK_SH
+	if excl {
+		how = syscall.LOCK_EX
+	}
+	for {
+		if err := syscall.Flock(int(ls.fh.Fd()), how); err != nil {
+			return fmt.Errorf("flock %s: %w", ls.path(), err)
+		}
+		// The log may have been replaced by a compaction.
+		fi, err := ls.fh.Stat()
+		if err != nil {
+			ls.end()
+			return err
+		}
+		if pfi, err := os.Stat(ls.path()); err == nil && os.SameFile(fi, pfi) {
+			break
+		}
+		ls.end()
+		ls.fh.Close()
+		if err := ls.open(); err != nil {
+			return err
+		}
+	}
+	if err := ls.replay(); err != nil {
+		ls.end()
+		return err
+	}
+	return nil
+}
+
+func (ls *logStorage) end() { _ = syscall.Flock(int(ls.fh.Fd()), syscall.LOCK_UN) }
+
+// replay applies the records appended since the last replay.
+//
+// Returns ErrCorrupt for a bad record which is not at the end of the log.
+func (ls *logStorage) replay() error {
+	var hdr [logHeaderLen]byte
+	for {
+		if _, err := ls.fh.ReadAt(hdr[:], ls.off); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[:4]))
+		if n == 0 {
+			// The header is written after the body: an unfinished append.
+			return nil
+		}
+		head := make([]byte, min(n, 4096))
+		if _, err := ls.fh.ReadAt(head, ls.off+logHeaderLen); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil // torn
+			}
+			return err
+		}
+		h := crc32.New(crcTable)
+		h.Write(head)
+		if rest := n - int64(len(head)); rest > 0 {
+			if _, err := io.Copy(h, io.NewSectionReader(ls.fh, ls.off+logHeaderLen+int64(len(head)), rest)); err != nil {
+				return err
+			}
+		}
+		if h.Sum32() != binary.BigEndian.Uint32(hdr[4:]) {
+			fi, err := ls.fh.Stat()
+			if err != nil {
+				return err
+			}
+			if end := ls.off + logHeaderLen + n; end < fi.Size() {
+				return fmt.Errorf("%w: %s: checksum mismatch of the record at %d, followed by %d bytes",
+					ErrCorrupt, ls.path(), ls.off, fi.Size()-end)
+			}
+			slog.Warn("torn log record", "file", ls.path(), "offset", ls.off)
+			return nil
+		}
+		if err := ls.apply(head, ls.off, n); err != nil {
+			slog.Warn("apply log record", "file", ls.path(), "offset", ls.off, "error", err)
+		}
+		ls.off += logHeaderLen + n
+	}
+}
+
+// apply the record (at off, with a body of n bytes starting with head) to the tree.
+func (ls *logStorage) apply(head []byte, off, n int64) error {
+	if len(head) < 2 {
+		return errors.New("short record")
+	}
+	op := head[0]
+	b := head[1:]
+	name, b, err := readString(b)
+	if err != nil {
+		return err
+	}
+	rec := logHeaderLen + n
+	switch op {
+	case logOpWrite, logOpMkdirAll:
+		if len(b) < 12 {
+			return errors.New("short record")
+		}
+		mode := fs.FileMode(binary.BigEndian.Uint32(b[:4]))
+		mtime := time.Unix(0, int64(binary.BigEndian.Uint64(b[4:12])))
+		if op == logOpMkdirAll {
+			return ls.tree.mkdirAll(name, mode, mtime)
+		}
+		dataOff := int64(len(head) - len(b) + 12)
+		nd := &node{off: off + logHeaderLen + dataOff, size: n - dataOff, rec: rec, mode: mode, modTime: mtime}
+		old, err := ls.tree.put("write", name, nd, false)
+		if old != nil {
+			ls.garbage += old.rec
+		}
+		return err
+	case logOpRename:
+		newname, _, err := readString(b)
+		if err != nil {
+			return err
+		}
+		ls.garbage += rec
+		old, err := ls.tree.rename(name, newname)
+		if old != nil {
+			ls.garbage += old.rec
+		}
+		return err
+	case logOpRemove:
+		ls.garbage += rec
+		old, err := ls.tree.remove(name)
+		if old != nil {
+			ls.garbage += old.rec
+		}
+		return err
+	case logOpRemoveAll:
+		ls.garbage += rec
+		for _, old := range ls.tree.removeAll(name) {
+			ls.garbage += old.rec
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown op %d", op)
+	}
+}
+
+func readString(b []byte) (string, []byte, error) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || uint64(len(b)-k) < n {
+		return "", b, errors.New("bad string")
+	}
+	return string(b[k : k+int(n)]), b[k+int(n):], nil
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+// append the record (prefix followed by the data read from r) to the log,
+// and applies it to the tree.
+//
+// Must be called between begin(true) and end.
+func (ls *logStorage) append(prefix []byte, r io.Reader) error {
+	start := ls.off
+	if fi, err := ls.fh.Stat(); err != nil {
+		return err
+	} else if fi.Size() > start {
+		// Truncate the torn record (replay has checked that it is the last one).
+		if err = ls.fh.Truncate(start); err != nil {
+			return err
+		}
+	}
+	var hdr [logHeaderLen]byte
+	h := crc32.New(crcTable)
+	w := &offsetWriter{w: ls.fh, off: start}
+	_, err := w.Write(hdr[:])
+	if err == nil {
+		_, err = io.MultiWriter(w, h).Write(prefix)
+	}
+	if err == nil && r != nil {
+		_, err = io.Copy(io.MultiWriter(w, h), r)
+	}
+	n := w.off - start - logHeaderLen
+	if err == nil && n > 1<<32-1 {
+		err = errors.New("record too large")
+	}
+	if err == nil {
+		binary.BigEndian.PutUint32(hdr[:4], uint32(n))
+		binary.BigEndian.PutUint32(hdr[4:], h.Sum32())
+		if _, err = ls.fh.WriteAt(hdr[:], start); err == nil && !ls.noSync {
+			err = ls.fh.Sync()
+		}
+	}
+	if err != nil {
+		_ = ls.fh.Truncate(start)
+		return err
+	}
+	ls.off = w.off
+	if err = ls.apply(prefix, start, n); err != nil {
+		return err
+	}
+	if ls.garbage > compactMinGarbage && 2*ls.garbage > ls.off {
+		if err := ls.compact(); err != nil {
+			slog.Error("compact", "file", ls.path(), "error", err)
+		}
+	}
+	return nil
+}
+
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.w.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// compact rewrites the log with the live records only.
+//
+// Must be called between begin(true) and end.
+func (ls *logStorage) compact() error {
+	slog.Info("compact", "file", ls.path(), "size", ls.off, "garbage", ls.garbage)
+	tmp := ls.path() + ".compact"
+	fh, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	old := ls
+	nls := &logStorage{dir: ls.dir, fh: fh, tree: newTree(), noSync: true}
+	names := make([]string, 0, len(old.tree.nodes))
+	for nm := range old.tree.nodes {
+		if nm != "." {
+			names = append(names, nm)
+		}
+	}
+	// Directories first, parents before children.
+	slices.SortFunc(names, func(a, b string) int {
+		if da, db := old.tree.nodes[a].mode.IsDir(), old.tree.nodes[b].mode.IsDir(); da != db {
+			if da {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a, b)
+	})
+	for _, nm := range names {
+		n := old.tree.nodes[nm]
+		if n.mode.IsDir() {
+			err = nls.append(logPrefix(logOpMkdirAll, nm, n.mode.Perm(), n.modTime), nil)
+		} else {
+			err = nls.append(logPrefix(logOpWrite, nm, n.mode, n.modTime),
+				io.NewSectionReader(old.fh, n.off, n.size))
+		}
+		if err != nil {
+			fh.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	if err = fh.Sync(); err == nil {
+		err = os.Rename(tmp, ls.path())
+	}
+	if err != nil {
+		fh.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	// The others wait for the lock of the old log, and will reopen.
+	if err = syscall.Flock(int(fh.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	ls.end()
+	ls.fh.Close()
+	ls.fh, ls.tree, ls.off, ls.garbage = nls.fh, nls.tree, nls.off, 0
+	return nil
+}
+
+func logPrefix(op byte, name string, mode fs.FileMode, mtime time.Time) []byte {
+	b := appendString(append(make([]byte, 0, 1+1+len(name)+12), op), name)
+	b = binary.BigEndian.AppendUint32(b, uint32(mode))
+	return binary.BigEndian.AppendUint64(b, uint64(mtime.UnixNano()))
+}
+
+// update runs f between begin(true) and end.
+func (ls *logStorage) update(f func() error) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.begin(true); err != nil {
+		return err
+	}
+	defer ls.end()
+	return f()
+}
+
+// view runs f between begin(false) and end.
+func (ls *logStorage) view(f func() error) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if err := ls.begin(false); err != nil {
+		return err
+	}
+	defer ls.end()
+	return f()
+}
+
+func (ls *logStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	var dis []fs.DirEntry
+	err := ls.view(func() error {
+		var err error
+		dis, err = ls.tree.readDir("readdir", name)
+		return err
+	})
+	return dis, err
+}
+
+func (ls *logStorage) Stat(name string) (fs.FileInfo, error) {
+	var fi fs.FileInfo
+	err := ls.view(func() error {
+		n, err := ls.tree.get("stat", name)
+		if err == nil {
+			fi = n.info(name)
+		}
+		return err
+	})
+	return fi, err
+}
+
+func (ls *logStorage) ReadFile(name string) ([]byte, error) {
+	var b []byte
+	err := ls.view(func() error {
+		n, err := ls.tree.getFile("read", name)
+		if err != nil {
+			return err
+		}
+		b = make([]byte, n.size)
+		_, err = ls.fh.ReadAt(b, n.off)
+		return err
+	})
+	return b, err
+}
+
+// Open the file, reading it through its own file descriptor of the log,
+// thus it is unaffected by a compaction.
+func (ls *logStorage) Open(name string) (fs.File, error) {
+	var lf *logFile
+	err := ls.view(func() error {
+		n, err := ls.tree.getFile("open", name)
+		if err != nil {
+			return err
+		}
+		fh, err := os.Open(ls.path())
+		if err != nil {
+			return err
+		}
+		lf = &logFile{SectionReader: io.NewSectionReader(fh, n.off, n.size), fh: fh, fi: n.info(name)}
+		return nil
+	})
+	return lf, err
+}
+
+type logFile struct {
+	*io.SectionReader
+	fh *os.File
+	fi fs.FileInfo
+}
+
+func (lf *logFile) Stat() (fs.FileInfo, error) { return lf.fi, nil }
+func (lf *logFile) Close() error               { return lf.fh.Close() }
+
+// checkPut checks whether the file can be written.
+func (ls *logStorage) checkPut(op, name string, excl bool) error {
+	name, err := cleanName(op, name)
+	if err != nil {
+		return err
+	}
+	if _, err = ls.tree.parent(op, name); err != nil {
+		return err
+	}
+	if n := ls.tree.nodes[name]; n != nil && (excl || n.mode.IsDir()) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	return nil
+}
+
+func (ls *logStorage) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	return ls.update(func() error {
+		if err := ls.checkPut("write", name, false); err != nil {
+			return err
+		}
+		return ls.append(logPrefix(logOpWrite, name, perm, time.Now()), r)
+	})
+}
+
+func (ls *logStorage) CreateFile(name string, data []byte, perm fs.FileMode) error {
+	return ls.update(func() error {
+		if err := ls.checkPut("create", name, true); err != nil {
+			return err
+		}
+		return ls.append(logPrefix(logOpWrite, name, perm, time.Now()), bytes.NewReader(data))
+	})
+}
+
+func (ls *logStorage) Rename(oldname, newname string) error {
+	return ls.update(func() error {
+		if _, err := ls.tree.getFile("rename", oldname); err != nil {
+			return err
+		}
+		if err := ls.checkPut("rename", newname, false); err != nil {
+			return err
+		}
+		return ls.append(appendString(appendString([]byte{logOpRename}, oldname), newname), nil)
+	})
+}
+
+func (ls *logStorage) Remove(name string) error {
+	return ls.update(func() error {
+		n, err := ls.tree.get("remove", name)
+		if err != nil {
+			return err
+		}
+		if n.mode.IsDir() && (name == "." || len(ls.tree.children[name]) != 0) {
+			return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+		}
+		return ls.append(appendString([]byte{logOpRemove}, name), nil)
+	})
+}
+
+func (ls *logStorage) RemoveAll(name string) error {
+	return ls.update(func() error {
+		if _, err := ls.tree.get("removeall", name); err != nil {
+			return nil
+		}
+		return ls.append(appendString([]byte{logOpRemoveAll}, name), nil)
+	})
+}
+
+func (ls *logStorage) MkdirAll(name string, perm fs.FileMode) error {
+	return ls.update(func() error {
+		if n, err := ls.tree.get("mkdir", name); err == nil {
+			if !n.mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+			}
+			return nil
+		}
+		return ls.append(logPrefix(logOpMkdirAll, name, perm, time.Now()), nil)
+	})
+}
+
+// Close the log.
+func (ls *logStorage) Close() error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.fh.Close()
+}
@@ -0,0 +1,322 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memStorage is the in-memory storage, for tests.
+type memStorage struct {
+	tree tree
+	mu   sync.Mutex
+}
+
+// NewMemStorage returns an in-memory storage (for tests).
+func NewMemStorage() Storage { return &memStorage{tree: newTree()} }
+
+func (ms *memStorage) ReadDir(name string) ([]fs.DirEntry, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.tree.readDir("readdir", name)
+}
+
+func (ms *memStorage) Stat(name string) (fs.FileInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	n, err := ms.tree.get("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(name), nil
+}
+
+func (ms *memStorage) ReadFile(name string) ([]byte, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	n, err := ms.tree.getFile("read", name)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Clone(n.data), nil
+}
+
+func (ms *memStorage) Open(name string) (fs.File, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	n, err := ms.tree.getFile("open", name)
+	if err != nil {
+		return nil, err
+	}
+	// The data is never modified in place.
+	return &memFile{Reader: bytes.NewReader(n.data), fi: n.info(name)}, nil
+}
+
+func (ms *memStorage) WriteFile(name string, r io.Reader, perm fs.FileMode) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, err = ms.tree.put("write", name, &node{data: b, size: int64(len(b)), mode: perm, modTime: time.Now()}, false)
+	return err
+}
+
+func (ms *memStorage) CreateFile(name string, data []byte, perm fs.FileMode) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, err := ms.tree.put("create", name, &node{data: bytes.Clone(data), size: int64(len(data)), mode: perm, modTime: time.Now()}, true)
+	return err
+}
+
+func (ms *memStorage) Rename(oldname, newname string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, err := ms.tree.rename(oldname, newname)
+	return err
+}
+
+func (ms *memStorage) Remove(name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	_, err := ms.tree.remove(name)
+	return err
+}
+
+func (ms *memStorage) RemoveAll(name string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.tree.removeAll(name)
+	return nil
+}
+
+func (ms *memStorage) MkdirAll(name string, perm fs.FileMode) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.tree.mkdirAll(name, perm, time.Now())
+}
+
+func (ms *memStorage) Close() error { return nil }
+
+type memFile struct {
+	*bytes.Reader
+	fi fs.FileInfo
+}
+
+func (mf *memFile) Stat() (fs.FileInfo, error) { return mf.fi, nil }
+func (mf *memFile) Close() error               { return nil }
+
+// node is a file or directory of the tree.
+type node struct {
+	modTime time.Time
+	// data is the contents of the file in memStorage.
+	data []byte
+	// off is the offset of the data in the log of logStorage,
+	// rec is the size of its record.
+	off, rec int64
+	size     int64
+	mode     fs.FileMode
+}
+
+func (n *node) info(name string) fileInfo {
+	return fileInfo{name: path.Base(name), size: n.size, mode: n.mode, modTime: n.modTime}
+}
+
+// tree is the index of the files and directories of the in-memory and log storages.
+type tree struct {
+	nodes    map[string]*node
+	children map[string]map[string]struct{}
+}
+
+func newTree() tree {
+	return tree{
+		nodes:    map[string]*node{".": {mode: fs.ModeDir | 0750}},
+		children: map[string]map[string]struct{}{".": {}},
+	}
+}
+
+func cleanName(op, name string) (string, error) {
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return name, nil
+}
+
+func (t tree) get(op, name string) (*node, error) {
+	name, err := cleanName(op, name)
+	if err != nil {
+		return nil, err
+	}
+	if n := t.nodes[name]; n != nil {
+		return n, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+func (t tree) getFile(op, name string) (*node, error) {
+	n, err := t.get(op, name)
+	if err == nil && n.mode.IsDir() {
+		err = &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return n, err
+}
+
+func (t tree) readDir(op, name string) ([]fs.DirEntry, error) {
+	n, err := t.get(op, name)
+	if err != nil {
+		return nil, err
+	}
+	if !n.mode.IsDir() {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	name, _ = cleanName(op, name)
+	dis := make([]fs.DirEntry, 0, len(t.children[name]))
+	for child := range t.children[name] {
+		dis = append(dis, t.nodes[child].info(child))
+	}
+	slices.SortFunc(dis, func(a, b fs.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return dis, nil
+}
+
+// parent checks that the parent directory of name exists.
+func (t tree) parent(op, name string) (string, error) {
+	dir := path.Dir(name)
+	if n := t.nodes[dir]; n == nil || !n.mode.IsDir() {
+		return dir, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return dir, nil
+}
+
+// put the file node into the tree, replacing the existing one iff !excl.
+//
+// Returns the replaced node.
+func (t tree) put(op, name string, n *node, excl bool) (*node, error) {
+	name, err := cleanName(op, name)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := t.parent(op, name)
+	if err != nil {
+		return nil, err
+	}
+	old := t.nodes[name]
+	if old != nil && (excl || old.mode.IsDir()) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+	t.nodes[name] = n
+	t.children[dir][name] = struct{}{}
+	return old, nil
+}
+
+// rename the file, returning the replaced node.
+func (t tree) rename(oldname, newname string) (*node, error) {
+	n, err := t.getFile("rename", oldname)
+	if err != nil {
+		return nil, err
+	}
+	if oldname == newname {
+		return nil, nil
+	}
+	old, err := t.put("rename", newname, n, false)
+	if err != nil {
+		return nil, err
+	}
+	t.unlink(oldname)
+	return old, nil
+}
+
+func (t tree) unlink(name string) {
+	delete(t.nodes, name)
+	delete(t.children[path.Dir(name)], name)
+}
+
+// remove the file or empty directory, returning its node.
+func (t tree) remove(name string) (*node, error) {
+	n, err := t.get("remove", name)
+	if err != nil {
+		return nil, err
+	}
+	if n.mode.IsDir() {
+		if name == "." || len(t.children[name]) != 0 {
+			return nil, &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+		}
+		delete(t.children, name)
+	}
+	t.unlink(name)
+	return n, nil
+}
+
+// removeAll removes the file or directory with all its descendants,
+// returning the removed file nodes.
+func (t tree) removeAll(name string) []*node {
+	name, err := cleanName("removeall", name)
+	if err != nil {
+		return nil
+	}
+	n := t.nodes[name]
+	if n == nil {
+		return nil
+	}
+	var removed []*node
+	if n.mode.IsDir() {
+		for child := range t.children[name] {
+			removed = append(removed, t.removeAll(child)...)
+		}
+		if name == "." {
+			return removed
+		}
+		delete(t.children, name)
+	} else {
+		removed = append(removed, n)
+	}
+	t.unlink(name)
+	return removed
+}
+
+func (t tree) mkdirAll(name string, perm fs.FileMode, now time.Time) error {
+	name, err := cleanName("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if n := t.nodes[name]; n != nil {
+		if !n.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+		return nil
+	}
+	if err = t.mkdirAll(path.Dir(name), perm, now); err != nil {
+		return err
+	}
+	t.nodes[name] = &node{mode: fs.ModeDir | perm.Perm(), modTime: now}
+	t.children[name] = make(map[string]struct{})
+	t.children[path.Dir(name)][name] = struct{}{}
+	return nil
+}
+
+// fileInfo is the fs.FileInfo and fs.DirEntry of the in-memory and log storages.
+type fileInfo struct {
+	modTime time.Time
+	name    string
+	size    int64
+	mode    fs.FileMode
+}
+
+func (fi fileInfo) Name() string               { return fi.name }
+func (fi fileInfo) Size() int64                { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi fileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() any                   { return nil }
+func (fi fileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
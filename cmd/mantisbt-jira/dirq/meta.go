@@ -0,0 +1,139 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+)
+
+// Due reports whether the item can be dequeued at now.
+func (m Meta) Due(now time.Time) bool { return !now.Before(m.DueAt()) }
+
+// DueAt returns the earliest time the item can be dequeued.
+func (m Meta) DueAt() time.Time {
+	if m.NotBefore.After(m.NextAttempt) {
+		return m.NotBefore
+	}
+	return m.NextAttempt
+}
+
+// DefaultBackoff is the default delay after the n-th failed attempt:
+// 15s, growing by 1.5x till 1h.
+func DefaultBackoff(n int) time.Duration {
+	d := 15 * time.Second
+	for ; n > 1 && d < time.Hour; n-- {
+		d += d / 2
+	}
+	return min(d, time.Hour)
+}
+
+func metaName(nm string) string { return strings.TrimSuffix(nm, ext) + metaExt }
+
+// readMeta reads the metadata of the item - returns the zero Meta if there is none.
+func (Q *Queue) readMeta(nm string) (Meta, error) {
+	return Q.readMetaFile(metaName(nm))
+}
+
+func (Q *Queue) readMetaFile(name string) (Meta, error) {
+	b, err := Q.st.ReadFile(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return Meta{}, err
+	}
+	return Q.decodeMeta(b)
+}
+
+// decodeMeta decodes the contents of a metadata file, decrypting it if needed.
+func (Q *Queue) decodeMeta(b []byte) (Meta, error) {
+	var m Meta
+	if IsSealed(b) {
+		var err error
+		if b, err = Q.Keys.Open(b); err != nil {
+			return m, err
+		}
+	}
+	err := json.Unmarshal(b, &m)
+	return m, err
+}
+
+// encodeMeta encodes the metadata for its file, encrypting it iff Keys is set,
+// as it contains the group, the last error and the result of the item.
+func (Q *Queue) encodeMeta(m Meta) ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil || Q.Keys == nil {
+		return b, err
+	}
+	return Q.Keys.Seal(b), nil
+}
+
+func (Q *Queue) writeMeta(dir, nm string, m Meta) error {
+	b, err := Q.encodeMeta(m)
+	if err != nil {
+		return err
+	}
+	return Q.writeFile(path.Join(dir, metaName(nm)), b, 0400)
+}
+
+func (Q *Queue) removeMeta(nm string) error { return Q.removeFile(metaName(nm)) }
+
+// fail records the failure of the claimed item, and releases it -
+// or moves it to the dead-letter directory if it is permanent,
+// or the attempts have been exhausted.
+//
+// Returns a *DeadLetterError iff the item has been moved.
+func (Q *Queue) fail(nm string, m Meta, err error) error {
+	now := time.Now()
+	if m.Attempts == 0 {
+		m.FirstFailure = now
+	}
+	m.Attempts++
+	m.LastFailure, m.LastError = now, err.Error()
+	if !errors.Is(err, ErrPermanent) && (Q.MaxAttempts <= 0 || m.Attempts < Q.MaxAttempts) {
+		backoff := Q.Backoff
+		if backoff == nil {
+			backoff = DefaultBackoff
+		}
+		m.NextAttempt = now.Add(backoff(m.Attempts))
+		if wErr := Q.writeMeta(".", nm, m); wErr != nil {
+			slog.Error("writeMeta", "name", nm, "error", wErr)
+		}
+		Q.release(nm)
+		return nil
+	}
+	m.Dead, m.NextAttempt = now, time.Time{}
+	if buryErr := Q.bury(nm+".y", m); buryErr != nil {
+		slog.Error("bury", "name", nm, "error", buryErr)
+		Q.release(nm)
+		return nil
+	}
+	_ = Q.removeFile(leaseName(nm[:26]))
+	return &DeadLetterError{Name: nm, Meta: m, Err: err}
+}
+
+// bury moves the item (pending, or claimed if src ends with ".y")
+// into the dead-letter directory, with a sidecar file containing the metadata.
+func (Q *Queue) bury(src string, m Meta) error { return Q.moveTo(DeadDir, src, m) }
+
+// moveTo moves the item (pending, or claimed if src ends with ".y")
+// into dir, with a sidecar file containing the metadata.
+func (Q *Queue) moveTo(dir, src string, m Meta) error {
+	nm := strings.TrimSuffix(src, ".y")
+	if err := Q.st.MkdirAll(dir, 0750); err != nil {
+		return err
+	}
+	if err := Q.writeMeta(dir, nm, m); err != nil {
+		return err
+	}
+	if err := Q.st.Rename(src, path.Join(dir, nm)); err != nil {
+		return err
+	}
+	return Q.removeMeta(nm)
+}
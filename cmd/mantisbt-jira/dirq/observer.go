@@ -0,0 +1,104 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// EventKind is the kind of a lifecycle event of an item.
+type EventKind uint8
+
+const (
+	// EventEnqueued: the item has been enqueued.
+	EventEnqueued = EventKind(iota + 1)
+	// EventDequeued: the item has been claimed, and is going to be processed.
+	EventDequeued
+	// EventSucceeded: the item has been processed.
+	EventSucceeded
+	// EventFailed: the processing of the item has failed, it will be retried.
+	EventFailed
+	// EventDeadLettered: the item has been moved to the dead-letter directory.
+	EventDeadLettered
+	// EventQuarantined: the corrupt item has been moved to the quarantine directory.
+	EventQuarantined
+	// EventSkipped: the item has already been processed (by a crashed consumer,
+	// or one that could not remove it), and has been removed without processing it.
+	EventSkipped
+	// EventDiscovered: the consumer has seen the pending item the first time
+	// (it may have been enqueued by another process, see EventEnqueued).
+	EventDiscovered
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventEnqueued:
+		return "enqueued"
+	case EventDequeued:
+		return "dequeued"
+	case EventSucceeded:
+		return "succeeded"
+	case EventFailed:
+		return "failed"
+	case EventDeadLettered:
+		return "dead-lettered"
+	case EventQuarantined:
+		return "quarantined"
+	case EventSkipped:
+		return "skipped"
+	case EventDiscovered:
+		return "discovered"
+	default:
+		return fmt.Sprintf("event(%d)", uint8(k))
+	}
+}
+
+// Event is a lifecycle event of an item, passed to the Observers.
+type Event struct {
+	Time time.Time
+	// Err is the error of the failed processing.
+	Err error
+	// ID is the ULID of the item.
+	ID    string
+	Group string
+	// Size is the size of the payload (zero for EventDiscovered and for the undecodable items).
+	Size int
+	// Duration is the time the item has spent in the queue for EventDiscovered and EventDequeued,
+	// and the processing time for the outcomes of the processing.
+	Duration time.Duration
+	// Attempts is the number of the failed attempts (with this one).
+	Attempts int
+	Kind     EventKind
+}
+
+// An Observer is called on the lifecycle events of the items.
+//
+// It is called synchronously, by the goroutine of the event
+// (see Workers), thus it must be quick, and safe for concurrent use.
+type Observer func(Event)
+
+// observe calls the Observers with the event of the item.
+func (Q *Queue) observe(kind EventKind, it *item, err error) {
+	if len(Q.Observers) == 0 {
+		return
+	}
+	e := Event{
+		Time: time.Now(), Kind: kind, Err: err,
+		ID: it.Name[:26], Group: it.Group, Size: it.size, Attempts: it.Attempts,
+	}
+	switch kind {
+	case EventDiscovered, EventDequeued:
+		if id, err := ulid.ParseStrict(e.ID); err == nil {
+			e.Duration = e.Time.Sub(ulid.Time(id.Time()))
+		}
+	case EventEnqueued:
+	default:
+		e.Duration = it.took
+	}
+	for _, o := range Q.Observers {
+		o(e)
+	}
+}
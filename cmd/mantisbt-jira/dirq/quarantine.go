@@ -0,0 +1,44 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// QuarantineDir is the name of the subdirectory of the corrupt items.
+const QuarantineDir = "quarantine"
+
+// QuarantineError is returned by Dequeue when a corrupt item (see ErrCorrupt)
+// has been moved to the quarantine directory.
+type QuarantineError struct {
+	Err  error
+	Name string
+	Meta Meta
+}
+
+func (qe *QuarantineError) Error() string {
+	return fmt.Sprintf("%s moved to %s: %v", qe.Name, QuarantineDir, qe.Err)
+}
+func (qe *QuarantineError) Unwrap() error { return qe.Err }
+
+// ListQuarantined lists the items of the quarantine directory, in order.
+func (Q *Queue) ListQuarantined() ([]Entry, error) { return Q.list(QuarantineDir) }
+
+// quarantine moves the claimed corrupt item to the quarantine directory,
+// so it does not block the queue.
+//
+// Returns a *QuarantineError iff the item has been moved,
+// and releases it (with the error) if it could not be moved.
+func (Q *Queue) quarantine(nm string, m Meta, err error) error {
+	m.Quarantined, m.LastError, m.NextAttempt = time.Now(), err.Error(), time.Time{}
+	if mvErr := Q.moveTo(QuarantineDir, nm+".y", m); mvErr != nil {
+		slog.Error("quarantine", "name", nm, "error", mvErr)
+		Q.release(nm)
+		return err
+	}
+	_ = Q.removeFile(leaseName(nm[:26]))
+	return &QuarantineError{Name: nm, Meta: m, Err: err}
+}
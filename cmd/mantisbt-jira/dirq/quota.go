@@ -0,0 +1,113 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrFull is returned by Enqueue and PutBlob when the queue has reached
+// its MaxItems or MaxBytes limit.
+var ErrFull = errors.New("queue is full")
+
+// Usage returns the number of items (pending, in-flight, dead and quarantined),
+// and the bytes they occupy, with the blobs and the archive (see DoneDir):
+// the archived items do not count as items, but they do fill the disk.
+func (Q *Queue) Usage() (items int, bytes int64, err error) {
+	for _, dir := range []string{".", DeadDir, QuarantineDir} {
+		dis, err := Q.readDir(dir)
+		if len(dis) == 0 && err != nil {
+			return items, bytes, err
+		}
+		for _, di := range dis {
+			nm := di.Name()
+			if !di.Type().IsRegular() ||
+				!(strings.HasSuffix(nm, ext) || strings.HasSuffix(nm, ext+".y")) {
+				continue
+			}
+			items++
+			if fi, err := di.Info(); err == nil {
+				bytes += fi.Size()
+			}
+		}
+	}
+	dis, err := Q.readDir(BlobDir)
+	if len(dis) == 0 && err != nil {
+		return items, bytes, err
+	}
+	for _, di := range dis {
+		if fi, err := di.Info(); err == nil && fi.Mode().IsRegular() {
+			bytes += fi.Size()
+		}
+	}
+	for _, dir := range Q.doneDirs() {
+		dis, err := Q.readDir(dir)
+		if len(dis) == 0 && err != nil {
+			return items, bytes, err
+		}
+		for _, di := range dis {
+			if fi, err := di.Info(); err == nil && fi.Mode().IsRegular() {
+				bytes += fi.Size()
+			}
+		}
+	}
+	return items, bytes, nil
+}
+
+// checkQuota returns ErrFull if adding an item (iff item is true)
+// of the given size would exceed the limits.
+func (Q *Queue) checkQuota(item bool, size int64) error {
+	if Q.MaxItems <= 0 && Q.MaxBytes <= 0 {
+		return nil
+	}
+	items, bytes, err := Q.Usage()
+	if err != nil {
+		return err
+	}
+	if item && Q.MaxItems > 0 && items >= Q.MaxItems {
+		return fmt.Errorf("%w: %d items (max %d)", ErrFull, items, Q.MaxItems)
+	}
+	if Q.MaxBytes > 0 && bytes+size > Q.MaxBytes {
+		return fmt.Errorf("%w: %d+%d bytes (max %d)", ErrFull, bytes, size, Q.MaxBytes)
+	}
+	return nil
+}
+
+// quotaReader limits the reader to the free space of the queue.
+func (Q *Queue) quotaReader(r io.Reader) (io.Reader, error) {
+	if Q.MaxBytes <= 0 {
+		return r, nil
+	}
+	_, bytes, err := Q.Usage()
+	if err != nil {
+		return nil, err
+	}
+	if bytes >= Q.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes (max %d)", ErrFull, bytes, Q.MaxBytes)
+	}
+	return &limitedReader{r: r, n: Q.MaxBytes - bytes, max: Q.MaxBytes}, nil
+}
+
+// limitedReader returns ErrFull after reading more than n bytes.
+type limitedReader struct {
+	r      io.Reader
+	n, max int64
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.n < 0 {
+		return 0, fmt.Errorf("%w: blob exceeds the %d bytes limit", ErrFull, lr.max)
+	}
+	if int64(len(p)) > lr.n+1 {
+		p = p[:lr.n+1]
+	}
+	n, err := lr.r.Read(p)
+	lr.n -= int64(n)
+	if lr.n < 0 {
+		return n, fmt.Errorf("%w: blob exceeds the %d bytes limit", ErrFull, lr.max)
+	}
+	return n, err
+}
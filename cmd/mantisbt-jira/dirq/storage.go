@@ -0,0 +1,80 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Storage is the file system the queue keeps its items, metadata, blobs and keys in.
+//
+// Names are slash-separated paths relative to the root of the queue,
+// as in io/fs ("." is the root).
+// The implementations must be safe for concurrent use.
+type Storage interface {
+	// ReadDir returns the entries of the directory, sorted by name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// Open opens the file for reading.
+	Open(name string) (fs.File, error)
+	ReadFile(name string) ([]byte, error)
+	Stat(name string) (fs.FileInfo, error)
+	// WriteFile writes the contents of r into the file atomically,
+	// replacing the existing one.
+	WriteFile(name string, r io.Reader, perm fs.FileMode) error
+	// CreateFile creates the file with data, returning fs.ErrExist if it already exists.
+	CreateFile(name string, data []byte, perm fs.FileMode) error
+	// Rename the file atomically.
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Close() error
+}
+
+// Open the queue on the given storage.
+func Open(st Storage) (*Queue, error) {
+	Q := newQueue(st)
+	if d, ok := st.(interface{ Dir() string }); ok {
+		Q.Dir = d.Dir()
+	}
+	return Q, nil
+}
+
+// New opens the queue in dir, in the append-log storage if dir contains
+// a log (see NewLogStorage), in the directory storage otherwise.
+func New(dir string) (*Queue, error) {
+	if _, err := os.Stat(filepath.Join(dir, LogFileName)); err == nil {
+		st, err := NewLogStorage(dir)
+		if err != nil {
+			return nil, err
+		}
+		return Open(st)
+	}
+	return Open(NewDirStorage(dir))
+}
+
+func (Q *Queue) writeFile(name string, data []byte, perm fs.FileMode) error {
+	return Q.st.WriteFile(name, bytes.NewReader(data), perm)
+}
+
+// removeFile removes the file, ignoring its absence.
+func (Q *Queue) removeFile(name string) error {
+	if err := Q.st.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// readDir reads the directory, returning no error for a missing one.
+func (Q *Queue) readDir(name string) ([]fs.DirEntry, error) {
+	dis, err := Q.st.ReadDir(name)
+	if len(dis) == 0 && errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return dis, err
+}
@@ -0,0 +1,255 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package dirq
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testStorages(t *testing.T) map[string]func() Storage {
+	return map[string]func() Storage{
+		"dir": func() Storage { return NewDirStorage(t.TempDir()) },
+		"mem": NewMemStorage,
+		"log": func() Storage {
+			st, err := NewLogStorage(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return st
+		},
+	}
+}
+
+func TestStorage(t *testing.T) {
+	for name, newStorage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			st := newStorage()
+			defer st.Close()
+			if err := st.MkdirAll("a/b", 0750); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.WriteFile("a/b/x", strings.NewReader("x1"), 0400); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.WriteFile("a/b/x", strings.NewReader("x2"), 0400); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.WriteFile("no/x", strings.NewReader("x"), 0400); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("write into missing dir: %+v", err)
+			}
+			if err := st.CreateFile("a/y", []byte("y"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.CreateFile("a/y", []byte("y"), 0600); !errors.Is(err, fs.ErrExist) {
+				t.Errorf("create existing: %+v", err)
+			}
+			if b, err := st.ReadFile("a/b/x"); err != nil || string(b) != "x2" {
+				t.Errorf("read: %q (%+v)", b, err)
+			}
+			if fi, err := st.Stat("a/b/x"); err != nil || fi.Size() != 2 || fi.IsDir() {
+				t.Errorf("stat: %+v (%+v)", fi, err)
+			}
+			if err := st.Rename("a/b/x", "a/z"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.Stat("a/b/x"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("renamed still exists: %+v", err)
+			}
+			fh, err := st.Open("a/z")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(fh)
+			fh.Close()
+			if err != nil || string(b) != "x2" {
+				t.Errorf("open: %q (%+v)", b, err)
+			}
+			dis, err := st.ReadDir("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, di := range dis {
+				names = append(names, di.Name())
+			}
+			if got := strings.Join(names, ","); got != "b,y,z" {
+				t.Errorf("readdir: got %q, wanted b,y,z", got)
+			}
+			if err := st.Remove("a/y"); err != nil {
+				t.Fatal(err)
+			}
+			if err := st.Remove("a/y"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("remove missing: %+v", err)
+			}
+			if err := st.RemoveAll("a"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := st.ReadDir("a"); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("removed dir: %+v", err)
+			}
+		})
+	}
+}
+
+func TestStorageQueue(t *testing.T) {
+	ctx := context.Background()
+	for name, newStorage := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			Q, err := Open(newStorage())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer Q.Close()
+			Q.Archive = true
+			hsh, err := Q.PutBlob(strings.NewReader("blob"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = Q.Enqueue([]byte("ok"), WithKey("k1"), WithBlobs(hsh)); err != nil {
+				t.Fatal(err)
+			}
+			if err = Q.Enqueue([]byte("fail"), WithGroup("g")); err != nil {
+				t.Fatal(err)
+			}
+			Q.MaxAttempts = 1
+			var got []string
+			err = Q.Dequeue(ctx, func(ctx context.Context, p []byte) error {
+				got = append(got, string(p))
+				if string(p) == "fail" {
+					return errors.New("failed")
+				}
+				fh, err := Q.OpenBlob(hsh)
+				if err != nil {
+					return err
+				}
+				defer fh.Close()
+				if b, err := io.ReadAll(fh); err != nil || string(b) != "blob" {
+					t.Errorf("blob: %q (%+v)", b, err)
+				}
+				return nil
+			})
+			if de := (*DeadLetterError)(nil); !errors.As(err, &de) {
+				t.Fatalf("wanted DeadLetterError, got %+v", err)
+			}
+			if len(got) != 2 {
+				t.Errorf("got %q", got)
+			}
+			if err = Q.Enqueue([]byte("ok"), WithKey("k1")); err != nil {
+				t.Fatal(err)
+			}
+			if entries, err := Q.List(); err != nil || len(entries) != 0 {
+				t.Errorf("duplicate: %+v (%+v)", entries, err)
+			}
+			entries, err := Q.ListDead()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || !entries[0].Dead {
+				t.Fatalf("dead: %+v", entries)
+			}
+			if err = Q.Retry(entries[0].ID); err != nil {
+				t.Fatal(err)
+			}
+			if entries, err = Q.List(); err != nil || len(entries) != 1 {
+				t.Errorf("retried: %+v (%+v)", entries, err)
+			}
+			if err = Q.GCBlobs(0); err != nil {
+				t.Fatal(err)
+			}
+			if fh, err := Q.OpenBlob(hsh); err != nil {
+				t.Errorf("archived blob: %+v", err)
+			} else {
+				fh.Close()
+			}
+		})
+	}
+}
+
+func TestLogStorage(t *testing.T) {
+	dir := t.TempDir()
+	st, err := NewLogStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls := st.(*logStorage)
+	ls.noSync = true
+	// A second process sees the changes of the first.
+	other, err := NewLogStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("x"), 64<<10)
+	for i := range 40 {
+		if err = st.WriteFile("f", bytes.NewReader(big), 0400); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err = st.WriteFile("g", strings.NewReader("g"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, LogFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() >= 20*int64(len(big)) {
+		t.Errorf("log has not been compacted: %d", fi.Size())
+	}
+	if b, err := other.ReadFile("f"); err != nil || !bytes.Equal(b, big) {
+		t.Errorf("other: %d (%+v)", len(b), err)
+	}
+
+	// A torn record is ignored.
+	fh, err := os.OpenFile(filepath.Join(dir, LogFileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fh.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, logOpWrite}); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	reopened, err := NewLogStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := reopened.ReadFile("g"); err != nil || string(b) != "g" {
+		t.Errorf("reopened: %q (%+v)", b, err)
+	}
+	if err = reopened.Rename("g", "h"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := st.ReadFile("h"); err != nil || string(b) != "g" {
+		t.Errorf("after torn: %q (%+v)", b, err)
+	}
+
+	// New detects the log.
+	Q, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Q.Storage().(*logStorage); !ok {
+		t.Errorf("New: got %T, wanted *logStorage", Q.Storage())
+	}
+
+	// A corrupt record followed by others is not truncated.
+	if fh, err = os.OpenFile(filepath.Join(dir, LogFileName), os.O_RDWR, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fh.WriteAt([]byte{0xff}, logHeaderLen+1); err != nil {
+		t.Fatal(err)
+	}
+	fh.Close()
+	if _, err = NewLogStorage(dir); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("corrupt: got %+v, wanted %v", err, ErrCorrupt)
+	}
+	if fi2, err := os.Stat(filepath.Join(dir, LogFileName)); err != nil || fi2.Size() < fi.Size() {
+		t.Errorf("corrupt log truncated: %v (%+v)", fi2, err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// envelopeVersion is the version of the envelope written by this binary.
+//
+// Version 0 is the bare JSON-encoded task (without an envelope),
+// as written by the earlier versions.
+const envelopeVersion = 1
+
+// envelope is the on-disk format of a queued task.
+type envelope struct {
+	Headers envelopeHeaders `json:"h"`
+	Payload json.RawMessage `json:"p"`
+	Version int             `json:"v"`
+}
+
+type envelopeHeaders struct {
+	Enqueued      time.Time `json:"enqueued"`
+	Host          string    `json:"host,omitempty"`
+	CorrelationID string    `json:"correlationID,omitempty"`
+}
+
+// envelopeUpgraders upgrade an envelope of version i to version i+1.
+var envelopeUpgraders = []func([]byte) (envelope, error){
+	0: func(b []byte) (envelope, error) {
+		return envelope{Version: 1, Payload: json.RawMessage(b)}, nil
+	},
+}
+
+// newEnvelope wraps the task into an envelope of the current version.
+func newEnvelope(t task, correlationID string) ([]byte, error) {
+	p, err := json.Marshal(t)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	return json.Marshal(envelope{
+		Version: envelopeVersion,
+		Headers: envelopeHeaders{
+			Enqueued: time.Now(), Host: hostname,
+			CorrelationID: correlationID,
+		},
+		Payload: p,
+	})
+}
+
+// decodeEnvelope decodes the envelope, of any known version,
+// upgrading it to the current version.
+func decodeEnvelope(b []byte) (envelope, error) {
+	var probe struct {
+		Version *int `json:"v"`
+	}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return envelope{}, err
+	}
+	var env envelope
+	if probe.Version == nil { // version 0: a bare task
+		env.Version = 0
+	} else if *probe.Version > envelopeVersion {
+		return env, fmt.Errorf("unknown envelope version %d", *probe.Version)
+	} else if err := json.Unmarshal(b, &env); err != nil {
+		return env, err
+	}
+	for env.Version < envelopeVersion {
+		v := env.Version
+		var err error
+		if env, err = envelopeUpgraders[v](b); err != nil {
+			return env, fmt.Errorf("upgrade envelope from version %d: %w", v, err)
+		}
+		if b, err = json.Marshal(env); err != nil {
+			return env, err
+		}
+	}
+	return env, nil
+}
+
+// migrateEnvelope returns the item upgraded to the current envelope version,
+// or nil if it is already at the current version.
+func migrateEnvelope(b []byte) ([]byte, error) {
+	var probe struct {
+		Version *int `json:"v"`
+	}
+	if err := json.Unmarshal(b, &probe); err != nil {
+		return nil, err
+	}
+	if probe.Version != nil && *probe.Version == envelopeVersion {
+		return nil, nil
+	}
+	env, err := decodeEnvelope(b)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(env)
+}
+
+// decodeTask decodes the task from the (possibly old-format) queue item.
+func decodeTask(b []byte) (task, envelopeHeaders, error) {
+	var t task
+	env, err := decodeEnvelope(b)
+	if err != nil {
+		return t, env.Headers, err
+	}
+	err = json.Unmarshal(env.Payload, &t)
+	return t, env.Headers, err
+}
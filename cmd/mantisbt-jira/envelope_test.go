@@ -0,0 +1,80 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/UNO-SOFT/mantisbt-plugins-Jira/cmd/mantisbt-jira/dirq"
+)
+
+func TestEnvelope(t *testing.T) {
+	want := task{Name: "IssueAddComment", IssueID: "INCIDENT-1", Comment: "árvíztűrő", MantisID: 1}
+	v0, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := newEnvelope(want, "corr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{"v0": v0, "v1": v1} {
+		got, hdr, err := decodeTask(b)
+		if err != nil {
+			t.Fatalf("%s: %+v", name, err)
+		}
+		if got.Name != want.Name || got.IssueID != want.IssueID || got.Comment != want.Comment || got.MantisID != want.MantisID {
+			t.Errorf("%s: got %+v, wanted %+v", name, got, want)
+		}
+		if name == "v1" && (hdr.CorrelationID != "corr" || hdr.Enqueued.IsZero()) {
+			t.Errorf("%s: got headers %+v", name, hdr)
+		}
+	}
+
+	if _, _, err = decodeTask([]byte(`{"v":99,"p":{}}`)); err == nil {
+		t.Error("wanted error for unknown version")
+	}
+}
+
+func TestMigrateEnvelope(t *testing.T) {
+	want := task{Name: "IssueAddComment", IssueID: "INCIDENT-1", Comment: "árvíztűrő"}
+	v0, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Q, err := dirq.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Q.Close()
+	if err = Q.Enqueue(v0); err != nil {
+		t.Fatal(err)
+	}
+	v1, err := newEnvelope(want, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Q.Enqueue(v1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := Q.Rewrite(migrateEnvelope); err != nil || n != 1 {
+		t.Fatalf("migrated %d: %+v", n, err)
+	}
+	entries, err := Q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		b, err := Q.Read(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m, err := migrateEnvelope(b); err != nil || m != nil {
+			t.Errorf("%s: not migrated (%s): %+v", e.ID, b, err)
+		}
+		if got, _, err := decodeTask(b); err != nil || got.Comment != want.Comment {
+			t.Errorf("%s: got %+v: %+v", e.ID, got, err)
+		}
+	}
+}
@@ -37,6 +37,7 @@ type Jira struct {
 	token      *Token
 	// socket     string
 	tokensFile string
+	tokensMu   sync.Mutex
 }
 
 type JIRAIssueType struct {
@@ -745,28 +746,29 @@ type JSONCommentBody struct {
 }
 
 // IssueAddComment adds a comment to the issue.
-func (svc *Jira) IssueAddComment(ctx context.Context, issueID, body string) error {
+func (svc *Jira) IssueAddComment(ctx context.Context, issueID, body string) (JIRAComment, error) {
 	URL := svc.URLFor("issue", issueID, "comment")
+	var comment JIRAComment
 	b, err := json.Marshal(JSONCommentBody{Body: body}) //, Visibility: JIRAVisibility{Type: "role", Value: "Administrators"}})
 	if err != nil {
-		return fmt.Errorf("marshal JSONCommentBody: %w", err)
+		return comment, fmt.Errorf("marshal JSONCommentBody: %w", err)
 	}
 	req, err := svc.NewRequest(ctx, "POST", URL, b)
 	if err != nil {
-		return fmt.Errorf("NewRequest(POST, %q): %w", URL, err)
+		return comment, fmt.Errorf("NewRequest(POST, %q): %w", URL, err)
 	}
 	resp, err := svc.Do(ctx, req)
 	if err != nil {
 		logger.Error("IssueAddComment", "URL", req.URL, "headers", req.Header, "error", err)
-		return fmt.Errorf("Do %s %q: %w", req.Method, req.URL, err)
+		return comment, fmt.Errorf("Do %s %q: %w", req.Method, req.URL, err)
 	}
 	logger.Info("IssueAddComment", "resp", resp)
-	var comment JIRAComment
-	return json.Unmarshal(resp, &comment)
+	err = json.Unmarshal(resp, &comment)
+	return comment, err
 }
 
 // IssueAddAttachment uploads the attachment to the issue.
-func (svc *Jira) IssueAddAttachment(ctx context.Context, issueID, fileName, mimeType string, body io.Reader) error {
+func (svc *Jira) IssueAddAttachment(ctx context.Context, issueID, fileName, mimeType string, body io.Reader) ([]JIRAAttachment, error) {
 	// This resource expects a multipart post. The media-type multipart/form-data is defined in RFC 1867. Most client libraries have classes that make dealing with multipart posts simple. For instance, in Java the Apache HTTP Components library provides a MultiPartEntity that makes it simple to submit a multipart POST.
 	//
 	// In order to protect against XSRF attacks, because this method accepts multipart/form-data, it has XSRF protection on it. This means you must submit a header of X-Atlassian-Token: no-check with the request, otherwise it will be blocked.
@@ -774,37 +776,56 @@ func (svc *Jira) IssueAddAttachment(ctx context.Context, issueID, fileName, mime
 	// The name of the multipart/form-data parameter that contains attachments must be "file"
 	//
 	// curl -D- -u admin:admin -X POST -H "X-Atlassian-Token: no-check" -F "file=@myfile.txt" http://myhost/rest/api/2/issue/TEST-123/attachments
-	var buf bytes.Buffer
-	mw := multipart.NewWriter(&buf)
-	w, err := mw.CreateFormFile("file", fileName)
-	if err != nil {
-		return err
+	const maxSize = 128 << 20
+	// Stream files (with known size) from the disk, buffer anything else.
+	var size int64 = -1
+	if st, ok := body.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if fi, err := st.Stat(); err == nil && fi.Mode().IsRegular() {
+			size = min(fi.Size(), maxSize)
+		}
+	}
+	if size < 0 {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, io.LimitReader(body, maxSize)); err != nil {
+			return nil, fmt.Errorf("read body: %w", err)
+		}
+		body, size = bytes.NewReader(buf.Bytes()), int64(buf.Len())
 	}
-	if _, err = io.Copy(w, io.LimitReader(body, 128<<20)); err != nil {
-		return fmt.Errorf("read body: %w", err)
+	var head bytes.Buffer
+	mw := multipart.NewWriter(&head)
+	if _, err := mw.CreateFormFile("file", fileName); err != nil {
+		return nil, err
 	}
+	n := head.Len()
 	if err := mw.Close(); err != nil {
-		return err
+		return nil, err
 	}
+	tail := bytes.Clone(head.Bytes()[n:])
+	head.Truncate(n)
+
 	URL := svc.URLFor("issue", issueID, "attachments")
-	req, err := http.NewRequestWithContext(ctx, "POST", URL.String(), bytes.NewReader(buf.Bytes()))
+	req, err := http.NewRequestWithContext(ctx, "POST", URL.String(),
+		io.MultiReader(&head, io.LimitReader(body, size), bytes.NewReader(tail)))
 	if err != nil {
-		return fmt.Errorf("NewRequest(POST, %q): %w", URL, err)
+		return nil, fmt.Errorf("NewRequest(POST, %q): %w", URL, err)
 	}
+	req.ContentLength = int64(head.Len()) + size + int64(len(tail))
 	req.Header.Set("X-Atlassian-Token", "no-check")
 	req.Header.Set("Content-Type", mw.FormDataContentType())
 	resp, err := svc.Do(ctx, req)
 	if err != nil {
 		logger.Error("IssueAddAttachment", "resp", resp, "error", err)
-		return fmt.Errorf("IssueAddAttachment(%q): %w", URL, err)
+		return nil, fmt.Errorf("IssueAddAttachment(%q): %w", URL, err)
 	}
 	logger.Info("IssueAddAttachment", "resp", resp)
 	attachments := make([]JIRAAttachment, 0, 1)
-	return json.Unmarshal(resp, &attachments)
+	err = json.Unmarshal(resp, &attachments)
+	return attachments, err
 }
 
 type JIRAAttachment struct {
 	Self      string   `json:"self,omitempty"`
+	ID        string   `json:"id,omitempty"`
 	Filename  string   `json:"filename,omitempty"`
 	Created   string   `json:"created,omitempty"`
 	MimeType  string   `json:"mimeType,omitempty"`
@@ -1061,6 +1082,8 @@ func (svc *Jira) IssueDoTransitionTo(ctx context.Context, issueID, targetStatus,
 func (svc *Jira) Do(ctx context.Context, req *http.Request) (json.RawMessage, error) {
 	b, changed, err := svc.token.do(ctx, svc.HTTPClient, req)
 	if changed {
+		svc.tokensMu.Lock()
+		defer svc.tokensMu.Unlock()
 		if svc.tokens == nil {
 			svc.tokens = make(map[string]*Token)
 		}
@@ -1159,6 +1182,16 @@ func (je *JIRAError) Error() string {
 	}
 	return buf.String()
 }
+
+// StatusCode returns the HTTP status code from the error code,
+// or 0 if it is not a HTTP status.
+func (je *JIRAError) StatusCode() int {
+	s, _, _ := strings.Cut(strings.TrimSpace(je.Code), " ")
+	if i, err := strconv.Atoi(s); err == nil && 100 <= i && i < 600 {
+		return i
+	}
+	return 0
+}
 func (je *JIRAError) IsValid() bool {
 	return je != nil && (je.Code != "" || je.Fault.Code != "" || len(je.Messages) != 0)
 }
@@ -1185,9 +1218,12 @@ func (t *Token) do(ctx context.Context, httpClient *http.Client, req *http.Reque
 			httpClient.Transport = gzhttp.Transport(httpClient.Transport)
 		}
 	}
+	// Hold the lock only while ensuring the token,
+	// to allow concurrent requests.
 	t.mu.Lock()
-	defer t.mu.Unlock()
 	changed, err := t.ensure(ctx, httpClient)
+	jSessionID, accessToken := t.JSessionID, t.AccessToken
+	t.mu.Unlock()
 	if err != nil {
 		return nil, false, err
 	}
@@ -1202,19 +1238,21 @@ func (t *Token) do(ctx context.Context, httpClient *http.Client, req *http.Reque
 	   --header 'Cookie: JSESSIONID=...; TS0126a004=015d4139a83807c002e8dd16d46fa16563299b17c4a228ff33b64e12ada62f8cd7829575e919a595aefcd7736d6717351a163defa1; atlassian.xsrf.token=B0BO-X7QB-KBRG-M4RU_23574bc6e7a2f17160a6128c30ee1a58a7ec4eb5_lin' \
 	   --header 'Authorization: Bearer ...' \
 	*/
-	req.Header.Set("Cookie", "JSESSIONID="+t.JSessionID)
-	req.Header.Set("Authorization", "Bearer "+t.AccessToken)
+	req.Header.Set("Cookie", "JSESSIONID="+jSessionID)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
 	var respBuf bytes.Buffer
 	err = func() error {
 		start := time.Now()
 		resp, err := httpClient.Do(req.WithContext(ctx))
 		if err != nil {
+			promJiraRequests.Observe(time.Since(start).Seconds(), req.Method, "error")
 			logger.Error("do", "url", req.URL.String(), "method", req.Method, "dur", time.Since(start).String(), "error", err)
 			return fmt.Errorf("do %s %q: %w", req.Method, req.URL, err)
 		}
 		if resp == nil {
 			return fmt.Errorf("empty response")
 		}
+		promJiraRequests.Observe(time.Since(start).Seconds(), req.Method, strconv.Itoa(resp.StatusCode))
 		logger.Info("do", "url", req.URL.String(), "method", req.Method, "dur", time.Since(start).String(), "hasBody", resp.Body != nil, "status", resp.Status)
 		if resp.Body == nil {
 			return nil
@@ -1273,7 +1311,13 @@ func (t *Token) ensure(ctx context.Context, httpClient *http.Client) (bool, erro
 		}); err != nil {
 			return changed, fmt.Errorf("marshal userPass: %w", err)
 		}
-		try := func() error {
+		try := func() (err error) {
+			promAuthAttempts.Inc()
+			defer func() {
+				if err != nil {
+					promAuthFailures.Inc()
+				}
+			}()
 			req, err := http.NewRequestWithContext(ctx, "POST", t.AuthURL+"?grant_type=password", bytes.NewReader(reqBuf.Bytes()))
 			if err != nil {
 				return fmt.Errorf("NewRequest(POST, %q): %w", t.AuthURL, err)
@@ -3,11 +3,18 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMarshal(t *testing.T) {
@@ -71,3 +78,47 @@ func b64decode(s string) string {
 	}
 	return buf.String()
 }
+
+func TestIssueAddAttachment(t *testing.T) {
+	const content = "árvíztűrő tükörfúrógép"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fh, hdr, err := r.FormFile("file")
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer fh.Close()
+		b, _ := io.ReadAll(fh)
+		if hdr.Filename != "a.txt" || string(b) != content {
+			t.Errorf("got %q=%q", hdr.Filename, b)
+		}
+		w.Write([]byte(`[{"id":"1","filename":"a.txt"}]`))
+	}))
+	defer srv.Close()
+	URL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := Jira{URL: URL, HTTPClient: srv.Client(),
+		token: &Token{till: time.Now().Add(time.Hour), rawToken: rawToken{JSessionID: "x"}},
+	}
+	fn := filepath.Join(t.TempDir(), "a.txt")
+	if err = os.WriteFile(fn, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	ctx := context.Background()
+	for _, r := range []io.Reader{fh, strings.NewReader(content)} {
+		attachments, err := svc.IssueAddAttachment(ctx, "INCIDENT-1", "a.txt", "text/plain", r)
+		if err != nil {
+			t.Errorf("%T: %+v", r, err)
+		} else if len(attachments) != 1 || attachments[0].ID != "1" {
+			t.Errorf("%T: got %+v", r, attachments)
+		}
+	}
+}
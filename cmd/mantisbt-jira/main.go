@@ -16,8 +16,8 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/UNO-SOFT/mantisbt-plugins-Jira/cmd/mantisbt-jira/dirq"
@@ -36,21 +36,23 @@ var logger = zlog.NewLogger(zlog.MaybeConsoleHandler(&verbose, os.Stderr)).SLog(
 const (
 	// DefaultJiraURL is the default JIRA URL
 	DefaultJiraURL = "https://partnerapi-test.aegon.hu/partner/v1/ticket/update"
+
+	// ExitQueueFull is the exit code when the queue is full,
+	// and the direct call has failed, too.
+	ExitQueueFull = 100
 )
 
 func main() {
 	if err := Main(); err != nil {
 		logger.Error("Main", "error", err)
+		if errors.Is(err, dirq.ErrFull) {
+			os.Exit(ExitQueueFull)
+		}
 		var jerr *JIRAError
 		if errors.As(err, &jerr) {
 			//logger.Info("as jiraerr", "error", jerr, "code", jerr.Code)
-			if s, _, ok := strings.Cut(jerr.Code, " "); ok && s != "" {
-				//logger.Info("cut", "s", s)
-				if i, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
-					if 401 <= i && i < 500 {
-						os.Exit(i - 400)
-					}
-				}
+			if i := jerr.StatusCode(); 401 <= i && i < 500 {
+				os.Exit(i - 400)
 			}
 		}
 		os.Exit(1)
@@ -64,7 +66,45 @@ type SVC struct {
 	TokensFile                   string
 	JIRAUser, JIRAPassword       string
 	queueName                    string
+	correlationID                string
 	queue                        *dirq.Queue
+	queueMaxItems                int
+	queueMaxBytes                uint64
+	queueStorage                 string
+	queueKeyFile                 string
+	supersededMu                 sync.Mutex
+	// superseded are the transitions superseded by a later one, by its ID.
+	superseded map[string][][]byte
+}
+
+// directErr returns the error of the direct call made after a failed enqueue,
+// keeping the queue error if the queue is full.
+func directErr(queueErr, err error) error {
+	if err != nil && errors.Is(queueErr, dirq.ErrFull) {
+		return errors.Join(queueErr, err)
+	}
+	return err
+}
+
+// parseAt parses the scheduled time of a task: an RFC3339 time,
+// a local "2006-01-02 15:04" time, or a duration from now (like "2h30m").
+//
+// The empty string means no schedule (the zero time).
+func parseAt(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("parse time %q: %w", s, err)
+	}
+	return t, nil
 }
 
 // Main is the main function
@@ -80,8 +120,20 @@ func Main() error {
 	defer svc.Close()
 
 	var mantisID int
+	var idemKey, at string
+	const idemKeyUsage = "idempotency key: a task with the same key is queued only once"
+	const atUsage = "schedule the task for later: RFC3339 or \"2006-01-02 15:04\" time, or a duration from now (needs --queues)"
+	// scheduledAt returns the time given by --at.
+	scheduledAt := func() (time.Time, error) {
+		t, err := parseAt(at, time.Now())
+		if err == nil && !t.IsZero() && queuesDir == "" {
+			err = errors.New("--at needs --queues")
+		}
+		return t, err
+	}
 	FS := ff.NewFlagSet("attach")
 	FS.IntVar(&mantisID, 0, "mantisid", 0, "mantisID")
+	FS.StringVar(&idemKey, 0, "key", "", idemKeyUsage)
 	flagAttachFileName := FS.StringLong("filename", "", "override file name")
 	addAttachmentCmd := ff.Command{Name: "attach", Flags: FS,
 		Exec: func(ctx context.Context, args []string) error {
@@ -109,34 +161,73 @@ func Main() error {
 			b := a[:n]
 			mimeType := http.DetectContentType(b)
 			logger.Info("IssueAddAttachment", "issueID", issueID, "fileName", fileName, "mimeType", mimeType)
+			var body io.Reader = io.MultiReader(bytes.NewReader(b), r)
+			var queueErr error
 			if queuesDir != "" {
-				if b, err = io.ReadAll(io.MultiReader(bytes.NewReader(b), r)); err != nil {
-					return err
+				// Keep what the queue consumes from a non-seekable input (stdin),
+				// for the direct call if the queueing fails.
+				queueBody := body
+				var spool *os.File
+				if fi, err := r.Stat(); err != nil || !fi.Mode().IsRegular() {
+					if spool, err = os.CreateTemp("", "mantisbt-jira-attach-"); err != nil {
+						logger.Warn("create spool file", "error", err)
+					} else {
+						defer func() { spool.Close(); os.Remove(spool.Name()) }()
+						queueBody = io.TeeReader(body, spool)
+					}
 				}
-				if err = svc.Enqueue(ctx, queuesDir, task{
-					Name:    "IssueAddAttachment",
-					IssueID: issueID, MantisID: mantisID,
-					FileName: fileName, MIMEType: mimeType, Data: b,
-				}); err != nil {
-					logger.Error("queue", "error", err)
-				} else {
+				var blob string
+				if queueErr = svc.openQueue(queuesDir); queueErr == nil {
+					if blob, queueErr = svc.queue.PutBlob(queueBody); queueErr == nil {
+						queueErr = svc.Enqueue(ctx, queuesDir, task{
+							Name:    "IssueAddAttachment",
+							IssueID: issueID, MantisID: mantisID,
+							FileName: fileName, MIMEType: mimeType, Blob: blob,
+							Key: idemKey,
+						})
+					}
+				}
+				if queueErr == nil {
 					return nil
 				}
+				logger.Error("queue", "error", queueErr)
+				// The input has been (partially) consumed, read it back.
+				if blob != "" {
+					fh, openErr := svc.queue.OpenBlob(blob)
+					if openErr != nil {
+						return errors.Join(queueErr, openErr)
+					}
+					defer fh.Close()
+					body = fh
+				} else if spool != nil {
+					// The consumed part is in the spool, the rest is still in body.
+					if _, seekErr := spool.Seek(0, io.SeekStart); seekErr != nil {
+						return errors.Join(queueErr, seekErr)
+					}
+					body = io.MultiReader(spool, body)
+				} else if _, seekErr := r.Seek(0, io.SeekStart); seekErr != nil {
+					return errors.Join(queueErr, seekErr)
+				} else {
+					body = r
+				}
 			}
 			if err = svc.init(); err != nil {
-				return err
+				return directErr(queueErr, err)
 			}
 			if ok, err := svc.checkMantisIssueID(ctx, issueID, mantisID); err != nil {
-				return err
+				return directErr(queueErr, err)
 			} else if !ok {
 				return nil
 			}
-			return svc.IssueAddAttachment(ctx, issueID, fileName, mimeType, io.MultiReader(bytes.NewReader(b), r))
+			_, err = svc.IssueAddAttachment(ctx, issueID, fileName, mimeType, body)
+			return directErr(queueErr, err)
 		},
 	}
 
 	FS = ff.NewFlagSet("attach")
 	FS.IntVar(&mantisID, 0, "mantisid", 0, "mantisID")
+	FS.StringVar(&idemKey, 0, "key", "", idemKeyUsage)
+	FS.StringVar(&at, 0, "at", "", atUsage)
 	addCommentCmd := ff.Command{Name: "comment", Flags: FS,
 		Exec: func(ctx context.Context, args []string) error {
 			ctx, cancel := context.WithTimeout(ctx, timeout)
@@ -150,25 +241,34 @@ func Main() error {
 				}
 				body = buf.String()
 			}
+			atT, err := scheduledAt()
+			if err != nil {
+				return err
+			}
+			var queueErr error
 			if queuesDir != "" {
-				if err := svc.Enqueue(ctx, queuesDir, task{
+				if queueErr = svc.Enqueue(ctx, queuesDir, task{
 					Name:     "IssueAddComment",
 					MantisID: mantisID, IssueID: issueID, Comment: body,
-				}); err != nil {
-					logger.Error("queue", "error", err)
-				} else {
+					Key: idemKey, At: atT,
+				}); queueErr == nil {
 					return nil
+				} else if !atT.IsZero() {
+					// Do not do it now instead of later.
+					return queueErr
 				}
+				logger.Error("queue", "error", queueErr)
 			}
 			if err := svc.init(); err != nil {
-				return err
+				return directErr(queueErr, err)
 			}
 			if ok, err := svc.checkMantisIssueID(ctx, issueID, mantisID); err != nil {
-				return err
+				return directErr(queueErr, err)
 			} else if !ok {
 				return nil
 			}
-			return svc.IssueAddComment(ctx, issueID, body)
+			_, err = svc.IssueAddComment(ctx, issueID, body)
+			return directErr(queueErr, err)
 		},
 	}
 
@@ -262,6 +362,8 @@ func Main() error {
 	var comment string
 	FS = ff.NewFlagSet("transition to")
 	FS.StringVar(&comment, 'm', "comment", "", "comment")
+	FS.StringVar(&idemKey, 0, "key", "", idemKeyUsage)
+	FS.StringVar(&at, 0, "at", "", atUsage)
 	transitionToCmd := ff.Command{Name: "to", Flags: FS,
 		Usage: "to <issueID> <targetStatusID>",
 		Exec: func(ctx context.Context, args []string) error {
@@ -269,24 +371,30 @@ func Main() error {
 			defer cancel()
 			issueID := args[0]
 			targetStatusID := args[1]
+			atT, err := scheduledAt()
+			if err != nil {
+				return err
+			}
+			var queueErr error
 			if queuesDir != "" {
-				if err := svc.Enqueue(ctx, queuesDir, task{
+				if queueErr = svc.Enqueue(ctx, queuesDir, task{
 					Name:    "IssueDoTransitionTo",
 					IssueID: issueID, Comment: comment,
-					TargetStatusID: targetStatusID,
-				}); err != nil {
-					logger.Error("queue", "error", err)
-				} else {
+					TargetStatusID: targetStatusID, Key: idemKey, At: atT,
+				}); queueErr == nil {
 					return nil
+				} else if !atT.IsZero() {
+					return queueErr
 				}
+				logger.Error("queue", "error", queueErr)
 			}
 			if err := svc.init(); err != nil {
-				return err
+				return directErr(queueErr, err)
 			}
-			err := svc.IssueDoTransitionTo(ctx, issueID, targetStatusID, comment)
+			err = svc.IssueDoTransitionTo(ctx, issueID, targetStatusID, comment)
 			if err != nil {
 				fmt.Println("ERR", err)
-				return err
+				return directErr(queueErr, err)
 			}
 			return nil
 		},
@@ -294,6 +402,8 @@ func Main() error {
 
 	FS = ff.NewFlagSet("transition")
 	FS.StringVar(&comment, 'm', "comment", "", "comment")
+	FS.StringVar(&idemKey, 0, "key", "", idemKeyUsage)
+	FS.StringVar(&at, 0, "at", "", atUsage)
 	issueDoTransitionCmd := ff.Command{Name: "transition", Flags: FS,
 		Usage:       "transition <issueID> <transitionID>",
 		Subcommands: []*ff.Command{&transitionToCmd, &transitionsGetCmd},
@@ -302,24 +412,30 @@ func Main() error {
 			defer cancel()
 			issueID := args[0]
 			transitionID := args[1]
+			atT, err := scheduledAt()
+			if err != nil {
+				return err
+			}
+			var queueErr error
 			if queuesDir != "" {
-				if err := svc.Enqueue(ctx, queuesDir, task{
+				if queueErr = svc.Enqueue(ctx, queuesDir, task{
 					Name:    "IssueDoTransition",
 					IssueID: issueID, Comment: comment,
-					TransitionID: transitionID,
-				}); err != nil {
-					logger.Error("queue", "error", err)
-				} else {
+					TransitionID: transitionID, Key: idemKey, At: atT,
+				}); queueErr == nil {
 					return nil
+				} else if !atT.IsZero() {
+					return queueErr
 				}
+				logger.Error("queue", "error", queueErr)
 			}
 			if err := svc.init(); err != nil {
-				return err
+				return directErr(queueErr, err)
 			}
-			err := svc.IssueDoTransition(ctx, issueID, transitionID, comment)
+			err = svc.IssueDoTransition(ctx, issueID, transitionID, comment)
 			if err != nil {
 				fmt.Println("ERR", err)
-				return err
+				return directErr(queueErr, err)
 			}
 			return nil
 		},
@@ -335,13 +451,34 @@ func Main() error {
 	}
 
 	FS = ff.NewFlagSet("serve")
-	flagServeEmail := FS.StringLong("alert", "t.gulacsi+jira@unosoft.hu", "comma-separated list of emails to send alerts to")
+	flagServeAlert := FS.StringLong("alert", "t.gulacsi+jira@unosoft.hu", "comma-separated list of alert destinations: emails (sent with sendmail), mailto:, smtp://[user:pass@]host[:port]?from=...&to=..., https:// (JSON webhook) or file:// URLs")
+	flagServeMaxAttempts := FS.IntLong("max-attempts", 10, "move a task to the dead-letter directory after this many failures (0: never)")
+	flagServeArchive := FS.DurationLong("archive", 0, "keep the processed tasks with the Jira responses in the archive for this long (0: no archive); the archive counts in the queue-max-bytes limit")
+	flagServePoll := FS.DurationLong("poll-interval", dirq.DefaultPollInterval, "poll the queues at this interval when filesystem notifications are unavailable or miss events")
+	flagServeWorkers := FS.IntLong("workers", 1, "number of workers per queue (tasks of an issue are processed in order)")
+	flagServeLease := FS.DurationLong("lease", dirq.DefaultLeaseDuration, "a task of a crashed instance is retried by the other instances after this lease expires")
+	flagServeHTTP := FS.StringLong("http", "", "listen address of the /healthz, /readyz, /status, /metrics and POST /queues/{name}/restart endpoints, like localhost:8080 (none if empty)")
+	flagServeAudit := FS.StringLong("audit", "", "append the lifecycle events of the tasks (enqueued or discovered, dequeued, succeeded, failed, dead-lettered...) to this file, as JSON lines")
 	serveCmd := ff.Command{Name: "serve", Flags: FS,
 		Exec: func(ctx context.Context, args []string) error {
 			if len(args) != 0 {
 				queuesDir = args[0]
 			}
-			return serve(ctx, queuesDir, strings.Split(*flagServeEmail, ","))
+			keys, err := loadQueueKeys(svc.queueKeyFile)
+			if err != nil {
+				return err
+			}
+			return serve(ctx, queuesDir, serveOptions{
+				Keys:         keys,
+				AlertURLs:    strings.Split(*flagServeAlert, ","),
+				MaxAttempts:  *flagServeMaxAttempts,
+				Workers:      *flagServeWorkers,
+				PollInterval: *flagServePoll,
+				Archive:      *flagServeArchive,
+				Lease:        *flagServeLease,
+				AuditFile:    *flagServeAudit,
+				HTTPAddr:     *flagServeHTTP,
+			})
 		},
 	}
 
@@ -355,6 +492,11 @@ func Main() error {
 	FS.Value('v', "verbose", &verbose, "verbose logging")
 	flagVersion := FS.BoolLongDefault("version", false, "print version")
 	FS.StringVar(&queuesDir, 0, "queues", "", "queues directory")
+	FS.IntVar(&svc.queueMaxItems, 0, "queue-max-items", 0, "maximum number of items in the queue (0: no limit)")
+	FS.Uint64Var(&svc.queueMaxBytes, 0, "queue-max-bytes", 0, "maximum size of the queue, with the attachments and the archive (see --archive) (0: no limit)")
+	FS.StringVar(&svc.queueStorage, 0, "queue-storage", "dir", "storage of new queues: dir (a file per item) or log (a single append-only file)")
+	FS.StringVar(&svc.queueKeyFile, 0, "queue-key-file", "", "file of the keys encrypting the queues, the current one first - keep the old ones while the attachments and idempotency keys written with them are in use (default: the "+queueKeyEnv+" environment variable)")
+	FS.StringVar(&svc.correlationID, 0, "correlation-id", "", "correlation ID of the queued tasks (default: a new ULID)")
 	ucd, err := os.UserCacheDir()
 	if err != nil {
 		return err
@@ -367,6 +509,7 @@ func Main() error {
 			&addAttachmentCmd, &addCommentCmd,
 			&issueCmd,
 			&serveCmd,
+			newQueueCommand(&queuesDir, &svc.queueKeyFile, &svc.queueStorage),
 		},
 		Exec: func(ctx context.Context, args []string) error {
 			if len(args) == 0 {
@@ -0,0 +1,204 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/mantisbt-plugins-Jira/cmd/mantisbt-jira/dirq"
+)
+
+// queueMetrics are the counters of the lifecycle events of the tasks of a queue.
+type queueMetrics struct {
+	// Events counts the events by their kind.
+	Events map[string]int64
+	// LastEvent is the time of the last event.
+	LastEvent time.Time
+	// Waited is the total time the tasks have spent in the queue till their discovery and dequeue,
+	// Processed is the total processing time of the tasks (of the outcomes of their processing).
+	Waited, Processed time.Duration
+}
+
+// metricsRegistry holds the metrics of the queues, by queue name.
+type metricsRegistry struct {
+	queues map[string]*queueMetrics
+	mu     sync.Mutex
+}
+
+var metrics = &metricsRegistry{queues: make(map[string]*queueMetrics)}
+
+func init() {
+	expvar.Publish("queues", expvar.Func(func() any { return metrics.Snapshot() }))
+}
+
+// Observer returns the dirq.Observer feeding the metrics of the queue.
+func (mr *metricsRegistry) Observer(queue string) dirq.Observer {
+	return func(e dirq.Event) {
+		mr.mu.Lock()
+		defer mr.mu.Unlock()
+		qm := mr.queues[queue]
+		if qm == nil {
+			qm = &queueMetrics{Events: make(map[string]int64)}
+			mr.queues[queue] = qm
+		}
+		qm.Events[e.Kind.String()]++
+		qm.LastEvent = e.Time
+		switch e.Kind {
+		case dirq.EventDiscovered, dirq.EventDequeued:
+			qm.Waited += e.Duration
+		case dirq.EventSucceeded, dirq.EventFailed, dirq.EventDeadLettered, dirq.EventQuarantined, dirq.EventSkipped:
+			qm.Processed += e.Duration
+		}
+	}
+}
+
+// Snapshot returns a copy of the metrics of the queues.
+func (mr *metricsRegistry) Snapshot() map[string]queueMetrics {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	m := make(map[string]queueMetrics, len(mr.queues))
+	for k, qm := range mr.queues {
+		m[k] = queueMetrics{
+			Events: maps.Clone(qm.Events), LastEvent: qm.LastEvent,
+			Waited: qm.Waited, Processed: qm.Processed,
+		}
+	}
+	return m
+}
+
+// auditRecord is a line of the audit trail.
+type auditRecord struct {
+	Time     time.Time
+	Queue    string
+	Event    string
+	ID       string
+	Group    string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Size     int    `json:",omitempty"`
+	Duration string `json:",omitempty"`
+	Attempts int    `json:",omitempty"`
+}
+
+// auditTrail appends the lifecycle events of the tasks to a file, as JSON lines.
+type auditTrail struct {
+	fh *os.File
+	mu sync.Mutex
+}
+
+// openAuditTrail opens the audit trail file for appending.
+func openAuditTrail(fn string) (*auditTrail, error) {
+	fh, err := os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &auditTrail{fh: fh}, nil
+}
+
+func (at *auditTrail) Close() error {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	return at.fh.Close()
+}
+
+// Observer returns the dirq.Observer recording the events of the queue.
+func (at *auditTrail) Observer(queue string) dirq.Observer {
+	return func(e dirq.Event) {
+		rec := auditRecord{
+			Time: e.Time, Queue: queue, Event: e.Kind.String(),
+			ID: e.ID, Group: e.Group, Size: e.Size, Attempts: e.Attempts,
+		}
+		if e.Duration != 0 {
+			rec.Duration = e.Duration.String()
+		}
+		if e.Err != nil {
+			rec.Error = e.Err.Error()
+		}
+		b, err := json.Marshal(rec)
+		if err != nil {
+			logger.Error("marshal audit record", "record", rec, "error", err)
+			return
+		}
+		at.mu.Lock()
+		defer at.mu.Unlock()
+		if _, err = at.fh.Write(append(b, '\n')); err != nil {
+			logger.Error("write audit trail", "file", at.fh.Name(), "error", err)
+		}
+	}
+}
+
+// The Prometheus metrics of serve.
+var (
+	promTasks = newPromCounter("mantisbt_jira_tasks_total",
+		"Tasks processed, by task name and result (succeeded or failed).", "task", "result")
+	promJiraRequests = newPromHistogram("mantisbt_jira_http_request_duration_seconds",
+		"Latency of the Jira HTTP requests, by method and status code.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}, "method", "code")
+	promAuthAttempts = newPromCounter("mantisbt_jira_auth_attempts_total",
+		"Jira authentication attempts.")
+	promAuthFailures = newPromCounter("mantisbt_jira_auth_failures_total",
+		"Failed Jira authentication attempts.")
+	promAlerts = newPromCounter("mantisbt_jira_alerts_total",
+		"Alerts, by result (sent or failed).", "result")
+)
+
+// observeTask counts the processed task by its result.
+func observeTask(name string, err error) {
+	result := "succeeded"
+	if err != nil {
+		result = "failed"
+	}
+	promTasks.Inc(name, result)
+}
+
+// writeMetrics writes the metrics in the Prometheus text format:
+// the depth of the queues (of ss), the lifecycle events of their tasks,
+// and the counters above.
+func writeMetrics(w io.Writer, ss *serveState) {
+	queueLabels := []string{"queue", "state"}
+	statuses := ss.Status()
+	promHeader(w, "mantisbt_jira_queue_items", "Items of the queue, by state.", "gauge")
+	for _, st := range statuses {
+		promSample(w, "mantisbt_jira_queue_items", queueLabels, []string{st.Name, "pending"}, float64(st.Pending))
+		promSample(w, "mantisbt_jira_queue_items", queueLabels, []string{st.Name, "in_flight"}, float64(st.InFlight))
+		promSample(w, "mantisbt_jira_queue_items", queueLabels, []string{st.Name, "dead"}, float64(st.Dead))
+		promSample(w, "mantisbt_jira_queue_items", queueLabels, []string{st.Name, "quarantined"}, float64(st.Quarantined))
+	}
+	promHeader(w, "mantisbt_jira_queue_oldest_item_age_seconds", "Waiting time of the oldest due (not in-flight, not delayed) item of the queue (the delivery lag).", "gauge")
+	for _, st := range statuses {
+		var age float64
+		if !st.oldestDue.IsZero() {
+			age = time.Since(st.oldestDue).Seconds()
+		}
+		promSample(w, "mantisbt_jira_queue_oldest_item_age_seconds", []string{"queue"}, []string{st.Name}, age)
+	}
+	promHeader(w, "mantisbt_jira_auth_backoff", "Whether the queue waits with the authentication backoff strategy.", "gauge")
+	for _, st := range statuses {
+		var v float64
+		if st.AuthBackoff {
+			v = 1
+		}
+		promSample(w, "mantisbt_jira_auth_backoff", []string{"queue"}, []string{st.Name}, v)
+	}
+
+	snapshot := metrics.Snapshot()
+	promHeader(w, "mantisbt_jira_queue_events_total", "Lifecycle events of the tasks of the queue.", "counter")
+	for _, queue := range slices.Sorted(maps.Keys(snapshot)) {
+		events := snapshot[queue].Events
+		for _, event := range slices.Sorted(maps.Keys(events)) {
+			promSample(w, "mantisbt_jira_queue_events_total", []string{"queue", "event"}, []string{queue, event}, float64(events[event]))
+		}
+	}
+
+	promTasks.writeProm(w)
+	promJiraRequests.writeProm(w)
+	promAuthAttempts.writeProm(w)
+	promAuthFailures.writeProm(w)
+	promAlerts.writeProm(w)
+}
@@ -0,0 +1,153 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal implementation of the Prometheus text exposition format,
+// for the few metrics of serve (see metrics.go).
+
+// promLabels formats the label pairs as {name="value",...}.
+func promLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var buf strings.Builder
+	buf.WriteByte('{')
+	for i, nm := range names {
+		if i != 0 {
+			buf.WriteByte(',')
+		}
+		var v string
+		if i < len(values) {
+			v = values[i]
+		}
+		buf.WriteString(nm)
+		buf.WriteString(`="`)
+		buf.WriteString(promEscaper.Replace(v))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func promFloat(f float64) string { return strconv.FormatFloat(f, 'g', -1, 64) }
+
+func promHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// promCounter is a counter with labels.
+type promCounter struct {
+	values map[string]float64
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+}
+
+func newPromCounter(name, help string, labels ...string) *promCounter {
+	return &promCounter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc increments the counter of the label values.
+func (c *promCounter) Inc(labelValues ...string) {
+	k := promLabels(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[k]++
+	c.mu.Unlock()
+}
+
+// Get returns the value of the counter of the label values.
+func (c *promCounter) Get(labelValues ...string) float64 {
+	k := promLabels(c.labels, labelValues)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[k]
+}
+
+func (c *promCounter) writeProm(w io.Writer) {
+	promHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", c.name)
+	}
+	for _, k := range slices.Sorted(maps.Keys(c.values)) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, promFloat(c.values[k]))
+	}
+}
+
+// promHistogram is a histogram with labels.
+type promHistogram struct {
+	values  map[string]*histogramData
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+}
+
+type histogramData struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newPromHistogram(name, help string, buckets []float64, labels ...string) *promHistogram {
+	return &promHistogram{name: name, help: help, buckets: buckets, labels: labels, values: make(map[string]*histogramData)}
+}
+
+// Observe the value v for the label values.
+func (h *promHistogram) Observe(v float64, labelValues ...string) {
+	k := promLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	d := h.values[k]
+	if d == nil {
+		d = &histogramData{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = d
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			d.counts[i]++
+		}
+	}
+	d.sum += v
+	d.count++
+}
+
+func (h *promHistogram) writeProm(w io.Writer) {
+	promHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, k := range slices.Sorted(maps.Keys(h.values)) {
+		d := h.values[k]
+		// The "le" label goes after the others.
+		prefix := "{"
+		if k != "" {
+			prefix = k[:len(k)-1] + ","
+		}
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %d\n", h.name, prefix, promFloat(le), d.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", h.name, prefix, d.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, k, promFloat(d.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, k, d.count)
+	}
+}
+
+// promSample writes a sample (of a gauge computed at the time of the scrape).
+func promSample(w io.Writer, name string, labels, values []string, v float64) {
+	fmt.Fprintf(w, "%s%s %s\n", name, promLabels(labels, values), promFloat(v))
+}
@@ -0,0 +1,536 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/renameio/v2"
+	"github.com/peterbourgon/ff/v4"
+
+	"github.com/UNO-SOFT/mantisbt-plugins-Jira/cmd/mantisbt-jira/dirq"
+)
+
+// queueInfo is a queue in the queues directory.
+type queueInfo struct {
+	Q       *dirq.Queue
+	Name    string
+	BaseURL string
+}
+
+// listQueues lists the queues in queuesDir, with their base URL read
+// from their config - decrypting them with the keys of keyFile (see loadQueueKeys).
+func listQueues(queuesDir, keyFile string) ([]queueInfo, error) {
+	if queuesDir == "" {
+		return nil, errors.New("queues directory (--queues) is required")
+	}
+	keys, err := loadQueueKeys(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	dis, err := os.ReadDir(queuesDir)
+	if len(dis) == 0 && err != nil {
+		return nil, fmt.Errorf("ReadDir(%q): %w", queuesDir, err)
+	}
+	queues := make([]queueInfo, 0, len(dis))
+	for _, di := range dis {
+		if !di.Type().IsDir() {
+			continue
+		}
+		dir := filepath.Join(queuesDir, di.Name())
+		qi := queueInfo{Name: di.Name()}
+		if b, err := readConfig(filepath.Join(dir, configFileName), keys); err != nil {
+			logger.Warn("read config", "dir", dir, "error", err)
+		} else {
+			var cfg struct{ BaseURL string }
+			if err = json.Unmarshal(b, &cfg); err != nil {
+				logger.Warn("parse config", "dir", dir, "error", err)
+			}
+			qi.BaseURL = cfg.BaseURL
+		}
+		if qi.Q, err = dirq.New(dir); err != nil {
+			return queues, err
+		}
+		qi.Q.Keys = keys
+		queues = append(queues, qi)
+	}
+	return queues, nil
+}
+
+// findQueue finds the queue by its name or base URL.
+//
+// Several queues may share a base URL: that is an error, listing their names.
+func findQueue(queues []queueInfo, s string) (queueInfo, error) {
+	var found []queueInfo
+	for _, qi := range queues {
+		if qi.Name == s {
+			return qi, nil
+		} else if qi.BaseURL == s {
+			found = append(found, qi)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return queueInfo{}, fmt.Errorf("queue %q not found", s)
+	case 1:
+		return found[0], nil
+	}
+	names := make([]string, len(found))
+	for i, qi := range found {
+		names[i] = qi.Name
+	}
+	return queueInfo{}, fmt.Errorf("%q is ambiguous, it is the base URL of the queues %s", s, strings.Join(names, ", "))
+}
+
+// findItem finds the queue containing the item.
+func findItem(queues []queueInfo, id string) (queueInfo, dirq.Entry, error) {
+	for _, qi := range queues {
+		if e, err := qi.Q.Find(id); err == nil {
+			return qi, e, nil
+		} else if !errors.Is(err, dirq.ErrNotFound) {
+			return qi, e, err
+		}
+	}
+	return queueInfo{}, dirq.Entry{}, fmt.Errorf("%s: %w", id, dirq.ErrNotFound)
+}
+
+func entryState(e dirq.Entry) string {
+	switch {
+	case e.Dead:
+		return "dead"
+	case e.Quarantined:
+		return "quarantined"
+	case e.InFlight:
+		if !e.Lease.Expires.IsZero() && e.Lease.Expired(time.Now()) {
+			return "in-flight (lease expired)"
+		}
+		return "in-flight"
+	case time.Now().Before(e.Meta.NotBefore):
+		return "scheduled at " + e.Meta.NotBefore.Format(time.RFC3339)
+	case !e.Meta.Due(time.Now()):
+		return "delayed"
+	default:
+		return "pending"
+	}
+}
+
+func newQueueCommand(queuesDir, keyFile, storage *string) *ff.Command {
+	var dead, quarantined bool
+	FS := ff.NewFlagSet("ls")
+	FS.BoolVar(&dead, 0, "dead", "list the dead-letter items")
+	FS.BoolVar(&quarantined, 0, "quarantine", "list the quarantined (corrupt) items")
+	lsCmd := ff.Command{Name: "ls", Flags: FS,
+		Usage:     "ls [--dead|--quarantine] [<queue name or base URL>]",
+		ShortHelp: "list the queues, or the items of a queue",
+		Exec: func(ctx context.Context, args []string) error {
+			queues, err := listQueues(*queuesDir, *keyFile)
+			if err != nil {
+				return err
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+			defer tw.Flush()
+			if len(args) == 0 {
+				fmt.Fprintln(tw, "NAME\tBASE URL\tCOUNT\tIN-FLIGHT\tDEAD\tQUARANTINE\tBYTES\tOLDEST")
+				for _, qi := range queues {
+					st, err := qi.Q.Stats()
+					if err != nil {
+						logger.Error("Stats", "queue", qi.Name, "error", err)
+					}
+					var oldest string
+					if !st.Oldest.IsZero() {
+						oldest = time.Since(st.Oldest).Truncate(time.Second).String()
+					}
+					fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t%s\n",
+						qi.Name, qi.BaseURL, st.Count, st.InFlight, st.Dead, st.Quarantined, st.Bytes, oldest)
+				}
+				return nil
+			}
+			qi, err := findQueue(queues, args[0])
+			if err != nil {
+				return err
+			}
+			list := qi.Q.List
+			if dead {
+				list = qi.Q.ListDead
+			} else if quarantined {
+				list = qi.Q.ListQuarantined
+			}
+			entries, err := list()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(tw, "ID\tENQUEUED\tSIZE\tSTATE\tATTEMPTS\tGROUP\tLAST ERROR")
+			for _, e := range entries {
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\t%s\n",
+					e.ID, e.Enqueued.Format(time.RFC3339), e.Size, entryState(e),
+					e.Meta.Attempts, e.Meta.Group, e.Meta.LastError)
+			}
+			return nil
+		},
+	}
+
+	showCmd := ff.Command{Name: "show",
+		Usage:     "show <id>",
+		ShortHelp: "show the item",
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return errors.New("item ID is required")
+			}
+			queues, err := listQueues(*queuesDir, *keyFile)
+			if err != nil {
+				return err
+			}
+			qi, _, err := findItem(queues, args[0])
+			if err != nil {
+				return err
+			}
+			p, e, err := qi.Q.Peek(args[0])
+			if err != nil {
+				return err
+			}
+			out := struct {
+				Task    *task            `json:",omitempty"`
+				Headers *envelopeHeaders `json:",omitempty"`
+				Raw     string           `json:",omitempty"`
+				Queue   string
+				BaseURL string
+				State   string
+				Entry   dirq.Entry
+			}{Queue: qi.Name, BaseURL: qi.BaseURL, State: entryState(e), Entry: e}
+			if t, hdr, err := decodeTask(p); err != nil {
+				logger.Warn("decode", "id", e.ID, "error", err)
+				out.Raw = string(p)
+			} else {
+				out.Task, out.Headers = &t, &hdr
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(out)
+		},
+	}
+
+	// onItem returns an Exec calling f with the queue of the item.
+	onItem := func(f func(qi queueInfo, id string, args []string) error) func(context.Context, []string) error {
+		return func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return errors.New("item ID is required")
+			}
+			queues, err := listQueues(*queuesDir, *keyFile)
+			if err != nil {
+				return err
+			}
+			qi, _, err := findItem(queues, args[0])
+			if err != nil {
+				return err
+			}
+			if err = f(qi, args[0], args[1:]); err != nil {
+				return err
+			}
+			logger.Info("done", "queue", qi.Name, "id", args[0])
+			return nil
+		}
+	}
+	retryCmd := ff.Command{Name: "retry",
+		Usage:     "retry <id>",
+		ShortHelp: "retry the item now (moving it back from the dead-letter or quarantine directory)",
+		Exec: onItem(func(qi queueInfo, id string, _ []string) error {
+			return qi.Q.Retry(id)
+		}),
+	}
+	rmCmd := ff.Command{Name: "rm",
+		Usage:     "rm <id>",
+		ShortHelp: "remove the item",
+		Exec: onItem(func(qi queueInfo, id string, _ []string) error {
+			return qi.Q.Remove(id)
+		}),
+	}
+	moveCmd := ff.Command{Name: "move",
+		Usage:     "move <id> [<reason>]",
+		ShortHelp: "move the item to the dead-letter directory",
+		Exec: onItem(func(qi queueInfo, id string, args []string) error {
+			reason := strings.Join(args, " ")
+			if reason == "" {
+				reason = "moved by hand"
+			}
+			return qi.Q.Kill(id, reason)
+		}),
+	}
+
+	var purgeDead bool
+	FS = ff.NewFlagSet("purge")
+	FS.BoolVar(&purgeDead, 0, "dead", "purge the dead-letter directory")
+	purgeCmd := ff.Command{Name: "purge", Flags: FS,
+		Usage:     "purge [--dead] <queue name or base URL>",
+		ShortHelp: "remove all the pending (or dead) items of the queue",
+		Exec: func(ctx context.Context, args []string) error {
+			if len(args) == 0 {
+				return errors.New("queue is required")
+			}
+			queues, err := listQueues(*queuesDir, *keyFile)
+			if err != nil {
+				return err
+			}
+			qi, err := findQueue(queues, args[0])
+			if err != nil {
+				return err
+			}
+			n, err := qi.Q.Purge(purgeDead)
+			fmt.Fprintf(os.Stdout, "%d items removed from %s\n", n, qi.Name)
+			return err
+		},
+	}
+
+	genkeyCmd := ff.Command{Name: "genkey",
+		Usage:     "genkey",
+		ShortHelp: "print a new key for encrypting the queues (put it first in the key file)",
+		Exec: func(ctx context.Context, args []string) error {
+			fmt.Println(dirq.NewKey())
+			return nil
+		},
+	}
+	rekeyCmd := ff.Command{Name: "rekey",
+		Usage:     "rekey [<queue name or base URL>]",
+		ShortHelp: "re-encrypt the queues (and their configs) with the current key",
+		Exec: func(ctx context.Context, args []string) error {
+			queues, err := listQueues(*queuesDir, *keyFile)
+			if err != nil {
+				return err
+			}
+			if len(args) != 0 {
+				qi, err := findQueue(queues, args[0])
+				if err != nil {
+					return err
+				}
+				queues = []queueInfo{qi}
+			}
+			var errs []error
+			for _, qi := range queues {
+				if qi.Q.Keys == nil {
+					return fmt.Errorf("no key (--queue-key-file or %s)", queueKeyEnv)
+				}
+				fn := filepath.Join(qi.Q.Dir, configFileName)
+				if b, err := readConfig(fn, qi.Q.Keys); err != nil {
+					errs = append(errs, err)
+				} else if err = writeConfig(fn, b, qi.Q.Keys); err != nil {
+					errs = append(errs, err)
+				}
+				n, err := qi.Q.Rekey()
+				fmt.Fprintf(os.Stdout, "%d files re-encrypted in %s\n", n, qi.Name)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", qi.Name, err))
+				}
+			}
+			return errors.Join(errs...)
+		},
+	}
+
+	migrateCmd := ff.Command{Name: "migrate",
+		Usage:     "migrate [<queue name or base URL>]",
+		ShortHelp: "rewrite the pending and dead items of the legacy formats in the current envelope version",
+		Exec: func(ctx context.Context, args []string) error {
+			queues, err := listQueues(*queuesDir, *keyFile)
+			if err != nil {
+				return err
+			}
+			if len(args) != 0 {
+				qi, err := findQueue(queues, args[0])
+				if err != nil {
+					return err
+				}
+				queues = []queueInfo{qi}
+			}
+			var errs []error
+			for _, qi := range queues {
+				n, err := qi.Q.Rewrite(migrateEnvelope)
+				fmt.Fprintf(os.Stdout, "%d items migrated in %s\n", n, qi.Name)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s: %w", qi.Name, err))
+				}
+			}
+			return errors.Join(errs...)
+		},
+	}
+
+	var exportFile string
+	var exportForce bool
+	FS = ff.NewFlagSet("export")
+	FS.StringVar(&exportFile, 'o', "output", "-", "archive file (- for stdout)")
+	FS.BoolVar(&exportForce, 0, "force", "export the in-flight items too (as pending), which may be processed twice")
+	exportCmd := ff.Command{Name: "export", Flags: FS,
+		Usage:     "export [-o <file>] [--force] [<queue name or base URL>]",
+		ShortHelp: "write the queues (their config, pending, dead and quarantined items) into a tar archive",
+		Exec: func(ctx context.Context, args []string) error {
+			queues, err := listQueues(*queuesDir, *keyFile)
+			if err != nil {
+				return err
+			}
+			if len(args) != 0 {
+				qi, err := findQueue(queues, args[0])
+				if err != nil {
+					return err
+				}
+				queues = []queueInfo{qi}
+			}
+			w := io.Writer(os.Stdout)
+			if exportFile != "" && exportFile != "-" {
+				fh, err := renameio.NewPendingFile(exportFile)
+				if err != nil {
+					return err
+				}
+				defer fh.Cleanup()
+				w = fh
+			}
+			tw := tar.NewWriter(w)
+			for _, qi := range queues {
+				if err = exportQueue(tw, qi, exportForce); err != nil {
+					return fmt.Errorf("%s: %w", qi.Name, err)
+				}
+			}
+			if err = tw.Close(); err != nil {
+				return err
+			}
+			if fh, ok := w.(*renameio.PendingFile); ok {
+				return fh.CloseAtomicallyReplace()
+			}
+			return nil
+		},
+	}
+	importCmd := ff.Command{Name: "import",
+		Usage:     "import [<file>]",
+		ShortHelp: "merge the queues of an archive (see export) into the queues directory",
+		Exec: func(ctx context.Context, args []string) error {
+			if *queuesDir == "" {
+				return errors.New("queues directory (--queues) is required")
+			}
+			r := io.Reader(os.Stdin)
+			if len(args) != 0 && args[0] != "-" {
+				fh, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer fh.Close()
+				r = fh
+			}
+			return importQueues(*queuesDir, *storage, tar.NewReader(r))
+		},
+	}
+
+	return &ff.Command{Name: "queue",
+		Usage:     "queue <subcommand>",
+		ShortHelp: "inspect and manage the queues",
+		Subcommands: []*ff.Command{
+			&lsCmd, &showCmd, &retryCmd, &rmCmd, &moveCmd, &purgeCmd,
+			&genkeyCmd, &rekeyCmd, &migrateCmd,
+			&exportCmd, &importCmd,
+		},
+		Exec: lsCmd.Exec,
+	}
+}
+
+// exportQueue writes the config and the items of the queue into tw,
+// under the name of the queue - the in-flight items only if inFlight is true.
+func exportQueue(tw *tar.Writer, qi queueInfo, inFlight bool) error {
+	fn := filepath.Join(qi.Q.Dir, configFileName)
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg, Name: path.Join(qi.Name, configFileName),
+		Mode: 0400, Size: int64(len(b)), ModTime: fi.ModTime(),
+	}); err != nil {
+		return err
+	}
+	if _, err = tw.Write(b); err != nil {
+		return err
+	}
+	n, err := qi.Q.Export(tw, qi.Name, inFlight)
+	logger.Info("exported", "queue", qi.Name, "items", n)
+	return err
+}
+
+// importQueues merges the queues of the archive into queuesDir,
+// creating the missing queues in storage.
+//
+// The config of an existing queue is kept.
+func importQueues(queuesDir, storage string, tr *tar.Reader) error {
+	queues := make(map[string]*dirq.Queue)
+	defer func() {
+		for _, Q := range queues {
+			Q.Close()
+		}
+	}()
+	counts := make(map[string]int)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name, rel, ok := strings.Cut(hdr.Name, "/")
+		if !ok || !fs.ValidPath(hdr.Name) || strings.HasPrefix(name, ".") {
+			return fmt.Errorf("%q: bad name", hdr.Name)
+		}
+		dir := filepath.Join(queuesDir, name)
+		if rel == configFileName {
+			fn := filepath.Join(dir, configFileName)
+			if _, err = os.Stat(fn); err == nil {
+				continue
+			}
+			b, err := io.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if err = os.MkdirAll(dir, 0750); err != nil {
+				return err
+			}
+			// The storage of a new queue must exist before its config.
+			if queues[name] == nil {
+				if queues[name], err = newQueue(dir, storage); err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+			}
+			if err = renameio.WriteFile(fn, b, 0400); err != nil {
+				return err
+			}
+			continue
+		}
+		Q := queues[name]
+		if Q == nil {
+			if Q, err = newQueue(dir, storage); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			queues[name] = Q
+		}
+		if ok, err := Q.Import(rel, hdr, tr); err != nil {
+			return fmt.Errorf("%s: %w", hdr.Name, err)
+		} else if ok {
+			counts[name]++
+		}
+	}
+	for name, n := range counts {
+		fmt.Fprintf(os.Stdout, "%d files imported into %s\n", n, name)
+	}
+	return nil
+}
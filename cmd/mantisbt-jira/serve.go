@@ -4,15 +4,19 @@ package main
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -20,6 +24,7 @@ import (
 	"time"
 
 	"github.com/google/renameio/v2"
+	"github.com/oklog/ulid/v2"
 	"github.com/rogpeppe/retry"
 
 	"github.com/UNO-SOFT/mantisbt-plugins-Jira/cmd/mantisbt-jira/dirq"
@@ -27,14 +32,79 @@ import (
 
 const configFileName = "jira-config.json"
 
+// queueKeyEnv is the environment variable holding the queue keys,
+// if no key file is given (see dirq.ParseKeys).
+const queueKeyEnv = "QUEUE_KEY"
+
+// loadQueueKeys loads the keys encrypting the queues from the file,
+// or from the environment - returns nil if there is none.
+func loadQueueKeys(keyFile string) (*dirq.Keyring, error) {
+	if keyFile != "" {
+		return dirq.ReadKeyFile(keyFile)
+	}
+	if s := os.Getenv(queueKeyEnv); s != "" {
+		keys, err := dirq.ParseKeys(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", queueKeyEnv, err)
+		}
+		return keys, nil
+	}
+	return nil, nil
+}
+
+// readConfig reads the config of a queue, decrypting it if it is encrypted.
+func readConfig(fn string, keys *dirq.Keyring) ([]byte, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil || !dirq.IsSealed(b) {
+		return b, err
+	}
+	if b, err = keys.Open(b); err != nil {
+		return nil, fmt.Errorf("%s: %w", fn, err)
+	}
+	return b, nil
+}
+
+// writeConfig writes the config of a queue (encrypted iff keys is not nil),
+// unless the file has the same contents already.
+func writeConfig(fn string, b []byte, keys *dirq.Keyring) error {
+	if old, err := os.ReadFile(fn); err == nil {
+		if keys == nil {
+			if dirq.IsSealed(old) {
+				logger.Warn("keep the encrypted config (no key)", "file", fn)
+				return nil
+			}
+			if bytes.Equal(old, b) {
+				return nil
+			}
+		} else if keys.SealedWithCurrent(old) {
+			if p, err := keys.Open(old); err == nil && bytes.Equal(p, b) {
+				return nil
+			}
+		}
+	}
+	if keys != nil {
+		b = keys.Seal(b)
+	}
+	logger.Info("write config", "file", fn)
+	return renameio.WriteFile(fn, b, 0400)
+}
+
 type task struct {
 	Name               string
 	IssueID, Comment   string
 	FileName, MIMEType string
 	TransitionID       string
 	TargetStatusID     string
-	Data               []byte
-	MantisID           int
+	// Key is the idempotency key of the task.
+	Key string `json:",omitempty"`
+	// Blob is the hash of the attachment in the blob area of the queue.
+	Blob string `json:",omitempty"`
+	// Data is the attachment - only in tasks written by the earlier versions.
+	Data     []byte `json:",omitempty"`
+	MantisID int
+	// At is the scheduled time of the task (see dirq.EnqueueAt),
+	// kept in the metadata of the queue item.
+	At time.Time `json:"-"`
 }
 
 func (svc *SVC) Close() error {
@@ -119,7 +189,34 @@ func (svc *SVC) checkMantisIssueID(ctx context.Context, issueID string, mantisID
 
 func (svc *SVC) Enqueue(ctx context.Context, queuesDir string, t task) error {
 	logger.Info("Enqueue", "queuesDir", queuesDir, "queue", svc.queueName)
-	if svc.queueName == "" || svc.queue.Dir == "" {
+	if err := svc.openQueue(queuesDir); err != nil {
+		return err
+	}
+	if svc.correlationID == "" {
+		svc.correlationID = ulid.Make().String()
+	}
+	body, err := newEnvelope(t, svc.correlationID)
+	if err != nil {
+		return err
+	}
+	// Tasks of the same issue must be processed in order.
+	opts := []dirq.Option{dirq.WithGroup(t.IssueID)}
+	if t.Blob != "" {
+		opts = append(opts, dirq.WithBlobs(t.Blob))
+	}
+	if t.Key != "" {
+		opts = append(opts, dirq.WithKey(t.Key))
+	}
+	if !t.At.IsZero() {
+		return svc.queue.EnqueueAt(t.At, body, opts...)
+	}
+	return svc.queue.Enqueue(body, opts...)
+}
+
+// openQueue opens the queue of the service (named by the hash of its config)
+// in queuesDir, writing the config if needed.
+func (svc *SVC) openQueue(queuesDir string) error {
+	if svc.queue == nil {
 		b, err := json.Marshal(svc)
 		if err != nil {
 			return err
@@ -128,245 +225,570 @@ func (svc *SVC) Enqueue(ctx context.Context, queuesDir string, t task) error {
 		svc.queueName = base64.URLEncoding.EncodeToString(hsh[:])
 		dir := filepath.Join(queuesDir, svc.queueName)
 		mkdErr := os.MkdirAll(dir, 0750)
+		keys, err := loadQueueKeys(svc.queueKeyFile)
+		if err != nil {
+			return err
+		}
+		// The storage of a new queue must exist before its config.
+		Q, err := newQueue(dir, svc.queueStorage)
+		if err != nil {
+			logger.Error("new queue", "dir", dir, "storage", svc.queueStorage, "error", err, "MkdirAll", mkdErr)
+			return err
+		}
 		fn := filepath.Join(dir, configFileName)
-		if fi, err := os.Stat(fn); !(err == nil && fi.Size() == int64(len(b))) {
-			logger.Info("write config", "file", fn)
-			if err = renameio.WriteFile(fn, b, 0400); err != nil {
-				logger.Error("Write config", "file", fn, "error", err, "MkdirAll", mkdErr)
-				return fmt.Errorf("write %q: %w", fn, err)
+		if err = writeConfig(fn, b, keys); err != nil {
+			Q.Close()
+			logger.Error("Write config", "file", fn, "error", err)
+			return fmt.Errorf("write %q: %w", fn, err)
+		}
+		svc.queue = Q
+		svc.queue.Keys = keys
+		svc.queue.MaxItems, svc.queue.MaxBytes = svc.queueMaxItems, int64(svc.queueMaxBytes)
+	}
+	return nil
+}
+
+// newQueue opens the queue in dir, creating it in the given storage ("dir" or "log")
+// if it does not exist yet.
+//
+// The log is created only in a new (empty) directory, thus newQueue must be called
+// before writing the config of the queue: an existing queue keeps its storage,
+// as it may be served already.
+func newQueue(dir, storage string) (*dirq.Queue, error) {
+	switch storage {
+	case "", "dir":
+		return dirq.New(dir)
+	case "log":
+		if _, err := os.Stat(filepath.Join(dir, dirq.LogFileName)); err == nil {
+			return dirq.New(dir)
+		}
+		if dis, err := os.ReadDir(dir); err == nil && len(dis) != 0 {
+			logger.Warn("keep the dir storage of the existing queue", "dir", dir)
+			return dirq.New(dir)
+		}
+		st, err := dirq.NewLogStorage(dir)
+		if err != nil {
+			return nil, err
+		}
+		return dirq.Open(st)
+	default:
+		return nil, fmt.Errorf("unknown queue storage %q (wanted dir or log)", storage)
+	}
+}
+
+// supersedingTransition returns the ID of a later IssueDoTransitionTo task
+// of the same issue in the queue, which makes t superfluous.
+//
+// Only the items due at the start of the Dequeue are considered (see dirq.LaterInGroup):
+// a transition scheduled for later does not supersede the current one.
+func (svc *SVC) supersedingTransition(ctx context.Context, t task) (string, error) {
+	if svc.queue == nil {
+		return "", nil
+	}
+	for _, id := range dirq.LaterInGroup(ctx) {
+		p, err := svc.queue.Read(dirq.Entry{ID: id})
+		if err != nil {
+			if errors.Is(err, dirq.ErrNotFound) {
+				continue
 			}
+			return "", err
 		}
-		if svc.queue, err = dirq.New(dir); err != nil {
-			logger.Error("new queue", "dir", dir, "error", err)
-			return err
+		if lt, _, err := decodeTask(p); err == nil &&
+			lt.Name == "IssueDoTransitionTo" && lt.IssueID == t.IssueID {
+			return id, nil
 		}
 	}
+	return "", nil
+}
 
-	body, err := json.Marshal(t)
-	if err != nil {
-		return err
+// supersede records the task p (being processed) as superseded by the task later,
+// with the tasks p has superseded.
+func (svc *SVC) supersede(ctx context.Context, later string, p []byte) {
+	id := dirq.ItemID(ctx)
+	svc.supersededMu.Lock()
+	defer svc.supersededMu.Unlock()
+	if svc.superseded == nil {
+		svc.superseded = make(map[string][][]byte)
+	}
+	svc.superseded[later] = append(append(svc.superseded[later], svc.superseded[id]...), p)
+	delete(svc.superseded, id)
+}
+
+// observeSuperseded is the Observer of the queue which enqueues again
+// the transitions superseded by a dead-lettered (or quarantined) one,
+// and forgets them when the superseding transition has succeeded.
+//
+// The superseded transitions are kept in memory only.
+func (svc *SVC) observeSuperseded(e dirq.Event) {
+	switch e.Kind {
+	case dirq.EventSucceeded, dirq.EventDeadLettered, dirq.EventQuarantined:
+	default:
+		return
+	}
+	svc.supersededMu.Lock()
+	ps := svc.superseded[e.ID]
+	delete(svc.superseded, e.ID)
+	svc.supersededMu.Unlock()
+	if e.Kind == dirq.EventSucceeded {
+		return
+	}
+	for _, p := range ps {
+		if err := svc.queue.Enqueue(p, dirq.WithGroup(e.Group)); err != nil {
+			logger.Error("enqueue superseded transition", "queue", svc.queueName, "by", e.ID, "error", err)
+		} else {
+			logger.Info("enqueued superseded transition", "queue", svc.queueName, "by", e.ID, "issueID", e.Group)
+		}
 	}
-	return svc.queue.Enqueue(body)
 }
 
 var errSkip = errors.New("skip")
 
-func serve(ctx context.Context, dir string, alertEmails []string) error {
-	logger.Debug("serve", "dir", dir)
-
-	sendAlert := func(err error) error { return nil }
-	sendAlerts := func() error { return nil }
-	if len(alertEmails) != 0 {
-		hostname, _ := os.Hostname()
-		var (
-			buf       bytes.Buffer
-			errs      []error
-			errsSeen  = make(map[string]struct{})
-			errsTimer *time.Timer
-			errsMu    sync.Mutex
-		)
-		sendAlert = func(alert error) error {
-			if alert == nil {
-				return nil
-			}
-			var doSend bool
-			errS := alert.Error()
-			errsMu.Lock()
-			if _, ok := errsSeen[errS]; !ok {
-				errsSeen[errS] = struct{}{}
-				errs = append(errs, alert)
-				if doSend = len(errs) >= 100; !doSend {
-					logger.Debug("sendAlert", "len", len(errs), "timer", errsTimer != nil)
-					if errsTimer == nil {
-						doSend = true
-						errsTimer = time.AfterFunc(15*time.Minute, func() { sendAlerts() })
-					}
-				}
-			}
-			errsMu.Unlock()
-			if doSend {
-				return sendAlerts()
-			}
-			return nil
+// taskResult is the response of Jira to a task, archived with the task.
+type taskResult struct {
+	CommentID     string   `json:",omitempty"`
+	AttachmentIDs []string `json:",omitempty"`
+	// SupersededBy is the ID of the later transition task, which made this one superfluous.
+	SupersededBy string `json:",omitempty"`
+}
+
+// processOne processes the task p, reporting its failure with sendAlert.
+func (svc *SVC) processOne(ctx context.Context, p []byte, logger *slog.Logger, sendAlert func(queue string, err error, id string) error) (err error) {
+	// The payload (may be encrypted at rest) is not logged, only its name, ID and issue.
+	logger = logger.With("id", dirq.ItemID(ctx))
+	t, hdr, err := decodeTask(p)
+	if err != nil {
+		logger.Error("decode task", "error", err)
+		// An undecodable task is quarantined, not retried.
+		return fmt.Errorf("%w: %w", dirq.ErrCorrupt, err)
+	}
+	logger = logger.With(slog.String("name", t.Name), "issueID", t.IssueID, "correlationID", hdr.CorrelationID)
+	defer func() {
+		observeTask(t.Name, err)
+		if err != nil {
+			logger.Error("processOne", "error", err, "isSkip", errors.Is(err, errSkip))
 		}
-		sendAlerts = func() error {
-			var alert error
-			errsMu.Lock()
-			if len(errs) != 0 {
-				alert = errors.Join(errs...)
-				errs = errs[:0]
-				clear(errsSeen)
-				if errsTimer != nil {
-					errsTimer.Stop()
-					errsTimer = nil
+	}()
+	logger.Debug("dequeued", "enqueued", hdr.Enqueued, "host", hdr.Host)
+	if ok, err := svc.checkMantisIssueID(ctx, t.IssueID, t.MantisID); err != nil {
+		return err
+	} else if !ok {
+		logger.Warn("not a JIRA issue", "mantisID", t.MantisID)
+		return nil
+	}
+	var result taskResult
+	switch t.Name {
+	case "IssueAddComment":
+		var comment JIRAComment
+		comment, err = svc.IssueAddComment(ctx, t.IssueID, t.Comment)
+		result.CommentID = comment.ID
+
+	case "IssueAddAttachment":
+		var r io.Reader = bytes.NewReader(t.Data)
+		if t.Blob != "" {
+			fh, openErr := svc.queue.OpenBlob(t.Blob)
+			if openErr != nil {
+				if errors.Is(openErr, dirq.ErrNoKey) {
+					return fmt.Errorf("open blob %q: %w", t.Blob, openErr)
 				}
+				return fmt.Errorf("%w: open blob %q: %w", dirq.ErrPermanent, t.Blob, openErr)
 			}
-			errsMu.Unlock()
-			logger.Debug("sendAlerts", "alert", alert)
-			if alert == nil {
-				return nil
+			defer fh.Close()
+			r = fh
+		}
+		var attachments []JIRAAttachment
+		attachments, err = svc.IssueAddAttachment(ctx, t.IssueID, t.FileName, t.MIMEType, r)
+		for _, a := range attachments {
+			result.AttachmentIDs = append(result.AttachmentIDs, a.ID)
+		}
+
+	case "IssueDoTransition":
+		err = svc.IssueDoTransition(ctx, t.IssueID, t.TransitionID, t.Comment)
+
+	case "IssueDoTransitionTo":
+		// Only the latest target status matters,
+		// the intermediate states may be unreachable.
+		if later, laterErr := svc.supersedingTransition(ctx, t); laterErr != nil {
+			logger.Warn("supersedingTransition", "issueID", t.IssueID, "error", laterErr)
+		} else if later != "" {
+			logger.Info("superseded", "issueID", t.IssueID, "targetStatusID", t.TargetStatusID, "by", later)
+			if t.Comment != "" {
+				var comment JIRAComment
+				comment, err = svc.IssueAddComment(ctx, t.IssueID, t.Comment)
+				result.CommentID = comment.ID
 			}
-			cmd := exec.CommandContext(ctx, "sendmail", alertEmails...)
-			buf.Reset()
-			fmt.Fprintf(&buf, "From: mantisbt-jira@"+hostname+"\r\nSubject: Mantis->JIRA hiba\r\n\r\n%+v", alert)
-			cmd.Stdin = bytes.NewReader(buf.Bytes())
-			if b, err := cmd.CombinedOutput(); err != nil {
-				logger.Error("sendmail", "args", cmd.Args, "output", string(b), "error", err)
-				return err
+			if err == nil {
+				svc.supersede(ctx, later, p)
 			}
-			logger.Info("sendmail", "args", cmd.Args)
-			return nil
+			result.SupersededBy = later
+			break
 		}
-		defer sendAlerts()
-	}
+		err = svc.IssueDoTransitionTo(ctx, t.IssueID, t.TargetStatusID, t.Comment)
 
-	processOne := func(ctx context.Context, svc *SVC, p []byte, logger *slog.Logger) error {
-		logger.Debug("Dequeue", "data", p)
-		var t task
-		if err := json.Unmarshal(p, &t); err != nil {
-			return err
-		}
-		logger.Debug("dequeued", slog.String("name", t.Name))
-		if ok, err := svc.checkMantisIssueID(ctx, t.IssueID, t.MantisID); err != nil {
-			return err
-		} else if !ok {
-			logger.Warn("not a JIRA issue", "issueID", t.IssueID, "mantisID", t.MantisID, "task", t)
-			return nil
+	default:
+		return fmt.Errorf("%q: %w", t.Name, errUnknownCommand)
+	}
+	if err != nil {
+		logger.Error("DO", "error", err)
+		if saErr := sendAlert(svc.queueName, err, t.IssueID); saErr != nil {
+			logger.Error("sendAlert", "sendAlert", saErr)
 		}
-		var err error
-		switch t.Name {
-		case "IssueAddComment":
-			err = svc.IssueAddComment(ctx, t.IssueID, t.Comment)
-
-		case "IssueAddAttachment":
-			err = svc.IssueAddAttachment(ctx, t.IssueID, t.FileName, t.MIMEType, bytes.NewReader(t.Data))
+		return err
+	}
+	if b, err := json.Marshal(result); err != nil {
+		logger.Warn("marshal result", "result", result, "error", err)
+	} else {
+		dirq.SetResult(ctx, b)
+	}
+	return nil
+}
 
-		case "IssueDoTransition":
-			err = svc.IssueDoTransition(ctx, t.IssueID, t.TransitionID, t.Comment)
+type serveOptions struct {
+	// AlertURLs are the destinations of the alerts (see newAlerter).
+	AlertURLs []string
+	// MaxAttempts is the number of failures after which a task is moved
+	// to the dead-letter directory.
+	MaxAttempts int
+	// Workers is the number of goroutines processing a queue
+	// (tasks of the same issue are processed in order, by the same goroutine).
+	Workers int
+	// Archive is the retention time of the processed tasks
+	// in the archive of the queue (no archive if not positive).
+	Archive time.Duration
+	// PollInterval is the polling interval of the queues,
+	// used when the filesystem notifications are not available.
+	PollInterval time.Duration
+	// Lease is the time after which the task of a crashed serve instance
+	// is taken by the other instances sharing the queue.
+	Lease time.Duration
+	// Keys decrypt the queues and their configs (nil if they are not encrypted).
+	Keys *dirq.Keyring
+	// AuditFile is the file the lifecycle events of the tasks are appended to
+	// (no audit trail if empty).
+	AuditFile string
+	// HTTPAddr is the listen address of the health and status endpoints
+	// (no listener if empty).
+	HTTPAddr string
+}
 
-		case "IssueDoTransitionTo":
-			err = svc.IssueDoTransitionTo(ctx, t.IssueID, t.TargetStatusID, t.Comment)
+func serve(ctx context.Context, dir string, opts serveOptions) error {
+	logger.Debug("serve", "dir", dir, "options", opts)
+	alerter, err := newAlerter(opts.AlertURLs)
+	if err != nil {
+		return err
+	}
 
-		default:
-			return fmt.Errorf("%q: %w", t.Name, errUnknownCommand)
+	// sendAlert records the error of the queue, with the ID of the issue (or item),
+	// observeAlerts recovers its alerts when it succeeds.
+	sendAlert := func(queue string, err error, id string) error { return nil }
+	var observeAlerts func(queue string) dirq.Observer
+	if alerter != nil {
+		notifier := newAlertNotifier(alerter)
+		sendAlert = func(queue string, err error, id string) error {
+			return notifier.Record(ctx, queue, err, id)
 		}
-		if err != nil {
-			logger.Error("DO", "name", t.Name, "task", t, "error", err)
-			if sendAlert != nil {
-				if saErr := sendAlert(err); saErr != nil {
-					logger.Error("sendAlert", "task", t, "sendAlert", saErr)
+		observeAlerts = func(queue string) dirq.Observer {
+			return func(e dirq.Event) {
+				if e.Kind == dirq.EventSucceeded {
+					notifier.Succeeded(queue, e.Group)
 				}
 			}
 		}
-		return err
+		go notifier.Run(ctx)
+		defer notifier.Flush(context.WithoutCancel(ctx))
 	}
 
-	services := make(map[string]*SVC)
-	defer func() {
-		for _, svc := range services {
-			svc.Close()
+	var audit *auditTrail
+	if opts.AuditFile != "" {
+		var err error
+		if audit, err = openAuditTrail(opts.AuditFile); err != nil {
+			return fmt.Errorf("open audit trail: %w", err)
 		}
-	}()
-	batch := func() error {
-		dis, err := os.ReadDir(dir)
-		if len(dis) == 0 && err != nil {
-			return fmt.Errorf("ReadDir(%q): %w", dir, err)
+		defer audit.Close()
+	}
+
+	state := newServeState()
+	if opts.HTTPAddr != "" {
+		if err := listenStatus(ctx, opts.HTTPAddr, state); err != nil {
+			return fmt.Errorf("status listener: %w", err)
 		}
-		for _, di := range dis {
-			if !di.Type().IsDir() {
-				continue
-			}
-			// Init only once per service
-			if _, ok := services[di.Name()]; ok {
-				continue
-			}
-			svc := new(SVC)
-			services[di.Name()] = svc
-			dir := filepath.Join(dir, di.Name())
-			logger := logger.With("queue", dir)
-			fn := filepath.Join(dir, configFileName)
-			logger.Info("Read config", "file", fn)
-			if b, err := os.ReadFile(fn); err != nil {
-				if os.IsNotExist(err) {
-					logger.Info("Read config", "file", fn, "error", err)
-				} else {
-					logger.Warn("Read config", "file", fn, "error", err)
-				}
-				continue
-			} else if err = json.Unmarshal(b, &svc); err != nil {
-				logger.Error("unmarshal %q: %w", string(b), err)
-				continue
-			}
-			// svc.TokensFile = filepath.Join(dir, "jira-token.json")
-			if err = svc.init(); err != nil {
-				return err
-			}
-			Q, err := dirq.New(dir)
-			if err != nil {
-				return err
-			}
-			g := func(ctx context.Context, msg []byte) error {
-				logger.Warn("processOne", "msg", string(msg))
-				if err := processOne(ctx, svc, msg, logger); err != nil {
-					logger.Error("processOne", "msg", msg, "error", err, "isSkip", errors.Is(err, errSkip))
-					if errors.Is(err, errSkip) || isIssueNotExist(err){
-						return nil
-					}
-					return err
+	}
+	services := state.services
+
+	// start the consumers of the queue name, with the config b.
+	start := func(name string, r *queueRunner, qs *queueState, b []byte) error {
+		svc := r.svc
+		if err := json.Unmarshal(b, &svc); err != nil {
+			return fmt.Errorf("unmarshal config: %w", err)
+		}
+		svc.queueName = name
+		// svc.TokensFile = filepath.Join(dir, "jira-token.json")
+		if err := svc.init(); err != nil {
+			return err
+		}
+		dir := filepath.Join(dir, name)
+		logger := logger.With("queue", dir)
+		Q, err := dirq.New(dir)
+		if err != nil {
+			return err
+		}
+		Q.MaxAttempts, Q.Workers = opts.MaxAttempts, opts.Workers
+		if opts.PollInterval > 0 {
+			Q.PollInterval = opts.PollInterval
+		}
+		if opts.Lease > 0 {
+			Q.LeaseDuration = opts.Lease
+		}
+		Q.Archive = opts.Archive > 0
+		Q.Keys = opts.Keys
+		Q.Observers = append(Q.Observers, metrics.Observer(name), qs.Observer(), svc.observeSuperseded)
+		if audit != nil {
+			Q.Observers = append(Q.Observers, audit.Observer(name))
+		}
+		if observeAlerts != nil {
+			Q.Observers = append(Q.Observers, observeAlerts(name))
+		}
+		svc.queue = Q
+		g := func(ctx context.Context, msg []byte) error {
+			if err := svc.processOne(ctx, msg, logger, sendAlert); err != nil {
+				if errors.Is(err, errSkip) || isIssueNotExist(err) {
+					return nil
 				}
-				return nil
+				return markError(err)
 			}
+			return nil
+		}
 
-			go func() {
-				normalStrategy := retry.Strategy{Delay: 15 * time.Second, MaxDelay: time.Hour, Factor: 1.5}
-				authErrStrategy := retry.Strategy{Delay: time.Hour, Factor: 2, MaxDelay: 6 * time.Hour}
-				var lastErrIsAuth bool
-				for iter := normalStrategy.Start(); ; {
-					if err := Q.Dequeue(ctx, g); err != nil {
-						var isAuth bool
-						if errors.Is(err, dirq.ErrEmpty) {
-							logger.Debug("Dequeue empty")
-						} else if errors.Is(err, errAuthenticate) {
-							logger.Warn("Dequeue", "error", err)
-							sendAlert(err)
-							isAuth = true
-						} else if os.IsNotExist(err) {
-							logger.Error("Deque", "error", err)
-							return
-						} else {
-							logger.Error("Dequeue", "error", err)
-						}
-						if lastErrIsAuth && !isAuth {
-							iter.Reset(&normalStrategy, nil)
-						} else if !lastErrIsAuth && isAuth {
-							iter.Reset(&authErrStrategy, nil)
-						}
-						lastErrIsAuth = isAuth
+		ctx, cancel := context.WithCancel(ctx)
+		r.cancel = cancel
+		r.wg.Add(2)
+		go func() {
+			defer r.wg.Done()
+			normalStrategy := retry.Strategy{Delay: 15 * time.Second, MaxDelay: time.Hour, Factor: 1.5}
+			authErrStrategy := retry.Strategy{Delay: time.Hour, Factor: 2, MaxDelay: 6 * time.Hour}
+			var lastErrIsAuth bool
+			for iter := normalStrategy.Start(); ; {
+				if err := Q.Dequeue(ctx, g); err != nil {
+					var isAuth bool
+					if errors.Is(err, dirq.ErrEmpty) {
+						logger.Debug("Dequeue empty")
+					} else if errors.Is(err, errAuthenticate) {
+						logger.Warn("Dequeue", "error", err)
+						sendAlert(name, err, "")
+						isAuth = true
+					} else if dlErr := (*dirq.DeadLetterError)(nil); errors.As(err, &dlErr) {
+						logger.Error("Dequeue dead letter", "error", err)
+						sendAlert(name, err, cmp.Or(dlErr.Meta.Group, dlErr.Name))
+					} else if qErr := (*dirq.QuarantineError)(nil); errors.As(err, &qErr) {
+						logger.Error("Dequeue quarantine", "error", err)
+						sendAlert(name, err, cmp.Or(qErr.Meta.Group, qErr.Name))
+					} else if errors.Is(err, dirq.ErrNoKey) {
+						// The items encrypted with a missing key are skipped.
+						logger.Error("Dequeue no key", "error", err)
+						sendAlert(name, err, "")
+					} else if errors.Is(err, dirq.ErrCorrupt) {
+						// The storage itself (the log) is corrupt.
+						logger.Error("Dequeue corrupt", "error", err)
+						sendAlert(name, err, "")
+					} else if os.IsNotExist(err) {
+						logger.Error("Deque", "error", err)
+						return
+					} else {
+						logger.Error("Dequeue", "error", err)
 					}
-					if !iter.Next(ctx.Done()) {
-						break
+					if lastErrIsAuth && !isAuth {
+						iter.Reset(&normalStrategy, nil)
+					} else if !lastErrIsAuth && isAuth {
+						iter.Reset(&authErrStrategy, nil)
 					}
+					lastErrIsAuth = isAuth
+					qs.setAuthBackoff(isAuth)
 				}
-			}()
-			go Q.Watch(ctx, g)
-		}
+				if !iter.Next(ctx.Done()) {
+					break
+				}
+			}
+		}()
+		go func() {
+			defer r.wg.Done()
+			Q.Watch(ctx, g)
+		}()
 		return nil
 	}
 
-	if err := batch(); err != nil {
+	rs := queueRunners{dir: dir, keys: opts.Keys, state: state, start: start,
+		runners: make(map[string]*queueRunner)}
+	defer rs.stop()
+
+	if err := rs.batch(); err != nil {
 		return err
 	}
+	state.SetReady()
 	ticker := time.NewTicker(time.Minute)
+	gcTicker := time.NewTicker(time.Hour)
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
 		case <-ticker.C:
-			if err := batch(); err != nil {
+			if err := rs.batch(); err != nil {
 				return err
 			}
+		case name := <-state.restarts:
+			if _, ok := rs.runners[name]; ok {
+				logger.Info("restart", "queue", name)
+				rs.reload(name, true)
+			}
+		case <-gcTicker.C:
+			for nm, svc := range services {
+				if svc.queue == nil {
+					continue
+				}
+				if err := svc.queue.GCBlobs(time.Hour); err != nil {
+					logger.Error("GCBlobs", "queue", nm, "error", err)
+				}
+				if err := svc.queue.PruneKeys(); err != nil {
+					logger.Error("PruneKeys", "queue", nm, "error", err)
+				}
+				if opts.Archive > 0 {
+					if err := svc.queue.PruneDone(opts.Archive); err != nil {
+						logger.Error("PruneDone", "queue", nm, "error", err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// queueRunner is a queue served by serve.
+type queueRunner struct {
+	svc *SVC
+	// cancel stops the consumers of the queue.
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// sum is the checksum of the config of the queue (zero if unreadable).
+	sum [sha256.Size]byte
+}
+
+// stop the consumers of the queue, waiting for them, and close the queue.
+func (r *queueRunner) stop() {
+	if r.cancel != nil {
+		r.cancel()
+	}
+	r.wg.Wait()
+	r.svc.Close()
+}
+
+// queueRunners are the queues served by serve: the subdirectories of dir.
+type queueRunners struct {
+	state *serveState
+	keys  *dirq.Keyring
+	// start the consumers of the queue name, with the config b.
+	start func(name string, r *queueRunner, qs *queueState, b []byte) error
+	// runners are the served queues, by name.
+	runners map[string]*queueRunner
+	dir     string
+}
+
+// reload (stop and start) the queue name if it is new, or its config has changed,
+// or restart is true.
+//
+// A queue which could not be started is started again by the next reload.
+func (rs *queueRunners) reload(name string, restart bool) {
+	fn := filepath.Join(rs.dir, name, configFileName)
+	b, err := readConfig(fn, rs.keys)
+	var sum [sha256.Size]byte
+	if err == nil {
+		sum = sha256.Sum256(b)
+	}
+	r := rs.runners[name]
+	if r != nil && !restart && r.sum == sum {
+		return
+	}
+	logger.Info("Read config", "file", fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Info("Read config", "file", fn, "error", err)
+		} else {
+			logger.Warn("Read config", "file", fn, "error", err)
+		}
+	}
+	event := "added"
+	if r != nil {
+		r.stop()
+		if event = "reloaded"; restart {
+			event = "restarted"
 		}
 	}
+	r = &queueRunner{svc: new(SVC), sum: sum}
+	rs.runners[name] = r
+	qs := rs.state.Add(name, r.svc)
+	if err == nil {
+		if err = rs.start(name, r, qs, b); err != nil {
+			logger.Error("start", "queue", name, "error", err)
+			// Retry with the next reload.
+			r.sum = [sha256.Size]byte{}
+		}
+	}
+	qs.setQueue(r.svc)
+	rs.state.Event(name, event, err)
+}
+
+// batch reloads the queues of the directory, and stops the removed ones.
+func (rs *queueRunners) batch() error {
+	dis, err := os.ReadDir(rs.dir)
+	if len(dis) == 0 && err != nil {
+		return fmt.Errorf("ReadDir(%q): %w", rs.dir, err)
+	}
+	for _, di := range dis {
+		if di.Type().IsDir() {
+			rs.reload(di.Name(), false)
+		}
+	}
+	// Stop the queues whose directory has been removed.
+	for name, r := range rs.runners {
+		if _, err := os.Stat(filepath.Join(rs.dir, name)); !os.IsNotExist(err) {
+			continue
+		}
+		logger.Info("queue removed", "queue", name)
+		r.stop()
+		delete(rs.runners, name)
+		rs.state.Remove(name)
+		rs.state.Event(name, "removed", nil)
+	}
+	return nil
+}
+
+// stop all the queues.
+func (rs *queueRunners) stop() {
+	for _, r := range rs.runners {
+		r.stop()
+	}
 }
 
 var errUnknownCommand = errors.New("unknown command")
+
+// markError marks the error for dirq:
+// unknown commands are permanent errors,
+// authentication, network, timeout and server errors are transient
+// (not the fault of the task), the other errors (a local failure too)
+// count as failed attempts - so a poison task ends up in the dead-letter directory.
+func markError(err error) error {
+	if err == nil || errors.Is(err, dirq.ErrPermanent) || errors.Is(err, dirq.ErrTransient) {
+		return err
+	}
+	if errors.Is(err, errUnknownCommand) {
+		return fmt.Errorf("%w: %w", dirq.ErrPermanent, err)
+	}
+	var ne net.Error
+	if errors.Is(err, errAuthenticate) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne) {
+		return fmt.Errorf("%w: %w", dirq.ErrTransient, err)
+	}
+	var je *JIRAError
+	if !errors.As(err, &je) {
+		return err
+	}
+	if code := je.StatusCode(); code == 0 || code == http.StatusTooManyRequests || code >= 500 {
+		return fmt.Errorf("%w: %w", dirq.ErrTransient, err)
+	}
+	return err
+}
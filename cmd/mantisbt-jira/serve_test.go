@@ -0,0 +1,723 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/mantisbt-plugins-Jira/cmd/mantisbt-jira/dirq"
+)
+
+func TestSupersedingTransition(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// /issue/{issueID}/{action}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 {
+			http.Error(w, "no such issue", http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			Body       string `json:"body"`
+			Transition struct {
+				ID string `json:"id"`
+			} `json:"transition"`
+		}
+		if r.Method == "POST" {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method + " " + parts[2] {
+		case "GET transitions":
+			w.Write([]byte(`{"transitions":[]}`))
+		case "POST transitions":
+			got = append(got, parts[1]+":"+body.Transition.ID)
+			w.Write([]byte(`{}`))
+		case "POST comment":
+			got = append(got, parts[1]+" "+body.Body)
+			w.Write([]byte(`{"id":"1"}`))
+		default:
+			http.Error(w, r.Method+" "+r.URL.Path, http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	URL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &SVC{Jira: Jira{URL: URL, HTTPClient: srv.Client(),
+		token: &Token{till: time.Now().Add(time.Hour), rawToken: rawToken{JSessionID: "x"}},
+	}}
+	queuesDir := t.TempDir()
+	enqueue := func(tasks ...task) {
+		t.Helper()
+		for _, tsk := range tasks {
+			if err := svc.Enqueue(ctx, queuesDir, tsk); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	noAlert := func(string, error, string) error { return nil }
+	f := func(ctx context.Context, p []byte) error { return svc.processOne(ctx, p, logger, noAlert) }
+	check := func(want ...string) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", want) {
+			t.Errorf("got %q, wanted %q", got, want)
+		}
+		got = got[:0]
+	}
+
+	enqueue(
+		task{Name: "IssueDoTransitionTo", IssueID: "A-1", TargetStatusID: "ON_HOLD", Comment: "hold"},
+		task{Name: "IssueAddComment", IssueID: "A-1", Comment: "comment"},
+		task{Name: "IssueDoTransitionTo", IssueID: "B-1", TargetStatusID: "RESOLVED"},
+		task{Name: "IssueDoTransitionTo", IssueID: "A-1", TargetStatusID: "IN_PROGRESS"},
+	)
+	svc.queue.MaxAttempts = 1
+	svc.queue.Observers = append(svc.queue.Observers, svc.observeSuperseded)
+	if err := svc.queue.Dequeue(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	// The superseded transition posts only its comment.
+	check("A-1 hold", "A-1 comment", "B-1:21", "A-1:11")
+
+	// The superseding transition dies (its issue cannot be checked):
+	// the superseded one is enqueued again.
+	enqueue(
+		task{Name: "IssueDoTransitionTo", IssueID: "C-1", TargetStatusID: "ON_HOLD"},
+		task{Name: "IssueDoTransitionTo", IssueID: "C-1", TargetStatusID: "IN_PROGRESS", MantisID: 1},
+	)
+	var dlErr *dirq.DeadLetterError
+	if err := svc.queue.Dequeue(ctx, f); !errors.As(err, &dlErr) {
+		t.Fatalf("got %+v, wanted DeadLetterError", err)
+	}
+	check()
+	if err := svc.queue.Dequeue(ctx, f); err != nil {
+		t.Fatal(err)
+	}
+	check("C-1:51")
+}
+
+func TestEnqueueStorages(t *testing.T) {
+	ctx := context.Background()
+	for _, storage := range []string{"dir", "log", "mem"} {
+		t.Run(storage, func(t *testing.T) {
+			queuesDir := t.TempDir()
+			svc := SVC{queueStorage: storage}
+			if storage == "mem" {
+				var err error
+				if svc.queue, err = dirq.Open(dirq.NewMemStorage()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := svc.Enqueue(ctx, queuesDir, task{Name: "IssueAddComment", IssueID: "A-1", Comment: storage}); err != nil {
+				t.Fatal(err)
+			}
+			if storage == "log" {
+				if _, err := os.Stat(filepath.Join(svc.queue.Dir, dirq.LogFileName)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var got []string
+			if err := svc.queue.Dequeue(ctx, func(ctx context.Context, p []byte) error {
+				tsk, _, err := decodeTask(p)
+				got = append(got, tsk.Comment)
+				return err
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0] != storage {
+				t.Errorf("got %q, wanted [%s]", got, storage)
+			}
+		})
+	}
+
+	// An existing (drained) queue keeps its storage.
+	queuesDir := t.TempDir()
+	for _, storage := range []string{"dir", "log"} {
+		svc := SVC{queueStorage: storage}
+		if err := svc.openQueue(queuesDir); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(svc.queue.Dir, dirq.LogFileName)); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, wanted no log", storage, err)
+		}
+		svc.queue.Close()
+	}
+}
+
+func TestEncryptedConfig(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv(queueKeyEnv, dirq.NewKey())
+	svc := SVC{BaseURL: "https://jira.example.com", JIRAPassword: "secret"}
+	queuesDir := t.TempDir()
+	if err := svc.Enqueue(ctx, queuesDir, task{Name: "IssueAddComment", IssueID: "A-1", Comment: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(svc.queue.Dir, configFileName)
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dirq.IsSealed(b) || bytes.Contains(b, []byte("secret")) {
+		t.Errorf("config is not encrypted: %q", b)
+	}
+	queues, err := listQueues(queuesDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queues) != 1 || queues[0].BaseURL != svc.BaseURL {
+		t.Fatalf("got %+v", queues)
+	}
+	entries, err := queues[0].Q.List()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("got %+v (%+v)", entries, err)
+	}
+	p, err := queues[0].Q.Read(entries[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsk, _, err := decodeTask(p); err != nil || tsk.Comment != "secret" {
+		t.Errorf("got %+v (%+v)", tsk, err)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	src, dst := t.TempDir(), t.TempDir()
+	svc := SVC{BaseURL: "https://jira.example.com"}
+	for _, tsk := range []task{
+		{Name: "IssueAddComment", IssueID: "A-1", Comment: "first", Key: "k1"},
+		{Name: "IssueAddComment", IssueID: "A-1", Comment: "second"},
+	} {
+		if err := svc.Enqueue(ctx, src, tsk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	blob, err := svc.queue.PutBlob(strings.NewReader("attachment"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.Enqueue(ctx, src, task{Name: "IssueAddAttachment", IssueID: "B-1", Blob: blob}); err != nil {
+		t.Fatal(err)
+	}
+	// An in-flight item is not exported, a quarantined one is.
+	for _, comment := range []string{"in flight", "quarantined"} {
+		if err = svc.Enqueue(ctx, src, task{Name: "IssueAddComment", IssueID: "C-1", Comment: comment}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcEntries, err := svc.queue.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(svc.queue.Dir, srcEntries[3].ID+".dirq-item.dat")
+	if err = os.Rename(fn, fn+".y"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(svc.queue.Dir, dirq.QuarantineDir), 0750); err != nil {
+		t.Fatal(err)
+	}
+	fn = srcEntries[4].ID + ".dirq-item.dat"
+	if err = os.Rename(filepath.Join(svc.queue.Dir, fn), filepath.Join(svc.queue.Dir, dirq.QuarantineDir, fn)); err != nil {
+		t.Fatal(err)
+	}
+	// Enqueued at the destination after the source items.
+	dstSvc := SVC{BaseURL: svc.BaseURL}
+	if err = dstSvc.Enqueue(ctx, dst, task{Name: "IssueAddComment", IssueID: "A-1", Comment: "third"}); err != nil {
+		t.Fatal(err)
+	}
+	dstSvc.Close()
+
+	queues, err := listQueues(src, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err = exportQueue(tw, queues[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ { // the second import is a no-op
+		if err = importQueues(dst, "dir", tar.NewReader(bytes.NewReader(buf.Bytes()))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if queues, err = listQueues(dst, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(queues) != 1 || queues[0].Name != svc.queueName || queues[0].BaseURL != svc.BaseURL {
+		t.Fatalf("got %+v", queues)
+	}
+	Q := queues[0].Q
+	entries, err := Q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		p, err := Q.Read(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tsk, _, err := decodeTask(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, tsk.Name+":"+tsk.Comment)
+	}
+	if want := "[IssueAddComment:first IssueAddComment:second IssueAddAttachment: IssueAddComment:third]"; fmt.Sprintf("%v", got) != want {
+		t.Errorf("got %v, wanted %s", got, want)
+	}
+	if entries[0].Meta.Group != "A-1" || entries[0].Meta.Key != "k1" {
+		t.Errorf("got meta %+v", entries[0].Meta)
+	}
+	if quarantined, err := Q.ListQuarantined(); err != nil || len(quarantined) != 1 || quarantined[0].ID != srcEntries[4].ID {
+		t.Errorf("got quarantined %+v (%+v)", quarantined, err)
+	}
+	fh, err := Q.OpenBlob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+	if b, err := io.ReadAll(fh); err != nil || string(b) != "attachment" {
+		t.Errorf("got blob %q (%+v)", b, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	ctx := context.Background()
+	svc := SVC{BaseURL: "https://jira.example.com"}
+	if err := svc.Enqueue(ctx, t.TempDir(), task{Name: "IssueAddComment", IssueID: "A-1", Comment: "pending"}); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	state := newServeState()
+	qs := state.Add(svc.queueName, &svc)
+	qs.setQueue(&svc)
+	qs.Observer()(dirq.Event{Kind: dirq.EventFailed, Time: time.Now(), Err: errors.New("boom")})
+	qs.setAuthBackoff(true)
+	srv := httptest.NewServer(state.Handler())
+	defer srv.Close()
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, string(b)
+	}
+	if code, _ := get("/healthz"); code != http.StatusOK {
+		t.Errorf("healthz: got %d", code)
+	}
+	if code, _ := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz before discovery: got %d", code)
+	}
+	state.SetReady()
+	if code, _ := get("/readyz"); code != http.StatusOK {
+		t.Errorf("readyz: got %d", code)
+	}
+	code, body := get("/status")
+	if code != http.StatusOK {
+		t.Fatalf("status: got %d", code)
+	}
+	var status struct{ Queues []queueStatus }
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("%s: %+v", body, err)
+	}
+	if len(status.Queues) != 1 {
+		t.Fatalf("got %+v", status)
+	}
+	st := status.Queues[0]
+	if st.Name != svc.queueName || st.BaseURL != svc.BaseURL || st.Pending != 1 || st.OldestAge == "" ||
+		st.LastError != "boom" || !st.AuthBackoff || !st.LastSuccess.IsZero() || st.Started.IsZero() {
+		t.Errorf("got %+v", st)
+	}
+
+	post := func(path string) int {
+		resp, err := http.Post(srv.URL+path, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post("/queues/" + svc.queueName + "/restart"); code != http.StatusAccepted {
+		t.Errorf("restart: got %d", code)
+	}
+	if name := <-state.restarts; name != svc.queueName {
+		t.Errorf("restart: got %q", name)
+	}
+	if code := post("/queues/unknown/restart"); code != http.StatusNotFound {
+		t.Errorf("restart unknown: got %d", code)
+	}
+	state.Event(svc.queueName, "added", nil)
+	state.Remove(svc.queueName)
+	state.Event(svc.queueName, "removed", nil)
+	_, body = get("/status")
+	var removed struct {
+		Queues []queueStatus
+		Events []queueEvent
+	}
+	if err := json.Unmarshal([]byte(body), &removed); err != nil {
+		t.Fatalf("%s: %+v", body, err)
+	}
+	if len(removed.Queues) != 0 || len(removed.Events) != 2 || removed.Events[1].Event != "removed" {
+		t.Errorf("after remove: got %+v", removed)
+	}
+}
+
+func TestQueueRunners(t *testing.T) {
+	dir := t.TempDir()
+	writeConfig := func(name, baseURL string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(dir, name), 0750); err != nil {
+			t.Fatal(err)
+		}
+		b := []byte(`{"BaseURL":"` + baseURL + `"}`)
+		if err := os.WriteFile(filepath.Join(dir, name, configFileName), b, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var started []string
+	startErr := errors.New("start failed")
+	var failStart bool
+	state := newServeState()
+	rs := queueRunners{dir: dir, state: state, runners: make(map[string]*queueRunner),
+		start: func(name string, r *queueRunner, qs *queueState, b []byte) error {
+			started = append(started, name)
+			if failStart {
+				return startErr
+			}
+			return nil
+		},
+	}
+	defer rs.stop()
+	batch := func(want ...string) {
+		t.Helper()
+		started = started[:0]
+		if err := rs.batch(); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(started) != fmt.Sprint(want) {
+			t.Errorf("started %v, wanted %v", started, want)
+		}
+	}
+
+	writeConfig("a", "https://a.example.com")
+	batch("a")
+	batch() // unchanged
+	writeConfig("a", "https://a2.example.com")
+	failStart = true
+	batch("a")
+	failStart = false
+	batch("a") // retried after the failed start
+	batch()
+	rs.reload("a", true)
+	if fmt.Sprint(started) != "[a]" {
+		t.Errorf("restart: started %v", started)
+	}
+	// An unreadable config is not started, and not retried.
+	if err := os.Mkdir(filepath.Join(dir, "b"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	batch()
+	batch()
+	if err := os.RemoveAll(filepath.Join(dir, "a")); err != nil {
+		t.Fatal(err)
+	}
+	batch()
+	if _, ok := rs.runners["a"]; ok {
+		t.Error("removed queue is still running")
+	}
+
+	var events []string
+	for _, e := range state.Events() {
+		events = append(events, e.Queue+":"+e.Event)
+	}
+	if want := "[a:added a:reloaded a:reloaded a:restarted b:added a:removed]"; fmt.Sprint(events) != want {
+		t.Errorf("got events %v, wanted %s", events, want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	svc := SVC{BaseURL: "https://jira.example.com"}
+	if err := svc.Enqueue(ctx, t.TempDir(), task{Name: "IssueAddComment", IssueID: "A-1", Comment: "pending"}); err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Close()
+	state := newServeState()
+	state.Add(svc.queueName, &svc).setQueue(&svc)
+	observeTask("IssueAddComment", nil)
+	observeTask("IssueDoTransition", errors.New("boom"))
+	promJiraRequests.Observe(0.3, "POST", "201")
+
+	var buf strings.Builder
+	writeMetrics(&buf, state)
+	got := buf.String()
+	for _, want := range []string{
+		`mantisbt_jira_queue_items{queue="` + svc.queueName + `",state="pending"} 1`,
+		`mantisbt_jira_queue_oldest_item_age_seconds{queue="` + svc.queueName + `"} `,
+		`mantisbt_jira_tasks_total{task="IssueAddComment",result="succeeded"} `,
+		`mantisbt_jira_tasks_total{task="IssueDoTransition",result="failed"} `,
+		`mantisbt_jira_http_request_duration_seconds_bucket{method="POST",code="201",le="0.25"} 0`,
+		`mantisbt_jira_http_request_duration_seconds_bucket{method="POST",code="201",le="0.5"} 1`,
+		`mantisbt_jira_http_request_duration_seconds_count{method="POST",code="201"} 1`,
+		"# TYPE mantisbt_jira_auth_failures_total counter\nmantisbt_jira_auth_failures_total 0\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%q not found in\n%s", want, got)
+		}
+	}
+
+	// The waiting time is not processing time.
+	mr := &metricsRegistry{queues: make(map[string]*queueMetrics)}
+	o := mr.Observer("q")
+	for _, e := range []dirq.Event{
+		{Kind: dirq.EventEnqueued},
+		{Kind: dirq.EventDiscovered, Duration: 2 * time.Second},
+		{Kind: dirq.EventDequeued, Duration: 3 * time.Second},
+		{Kind: dirq.EventSucceeded, Duration: time.Second},
+	} {
+		o(e)
+	}
+	if qm := mr.Snapshot()["q"]; qm.Waited != 5*time.Second || qm.Processed != time.Second || qm.Events["discovered"] != 1 {
+		t.Errorf("got %+v", qm)
+	}
+}
+
+func TestMarkError(t *testing.T) {
+	for _, tc := range []struct {
+		Err                  error
+		Transient, Permanent bool
+	}{
+		{fmt.Errorf("open blob: %w", dirq.ErrBadBlob), false, false},
+		{errors.New("undecodable response"), false, false},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true, false},
+		{fmt.Errorf("upload: %w", context.DeadlineExceeded), true, false},
+		{fmt.Errorf("%w: empty response", errAuthenticate), true, false},
+		{&JIRAError{Code: "503 Service Unavailable"}, true, false},
+		{&JIRAError{Code: "400 Bad Request"}, false, false},
+		{fmt.Errorf("%q: %w", "x", errUnknownCommand), false, true},
+	} {
+		err := markError(tc.Err)
+		if got := errors.Is(err, dirq.ErrTransient); got != tc.Transient {
+			t.Errorf("%v: got transient %t, wanted %t", tc.Err, got, tc.Transient)
+		}
+		if got := errors.Is(err, dirq.ErrPermanent); got != tc.Permanent {
+			t.Errorf("%v: got permanent %t, wanted %t", tc.Err, got, tc.Permanent)
+		}
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	if a, err := newAlerter([]string{""}); err != nil || a != nil {
+		t.Errorf("empty: got %v, %+v", a, err)
+	}
+	if _, err := newAlerter([]string{"gopher://example.com"}); err == nil {
+		t.Error("unknown scheme: wanted error")
+	}
+	a, err := newAlerter([]string{"a@example.com", "mailto:b@example.com,c@example.com", "smtp://u:p@mail.example.com?to=d@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ma, ok := a.(multiAlerter)
+	if !ok || len(ma) != 2 {
+		t.Fatalf("got %#v, wanted two alerters", a)
+	}
+	if sa := ma[0].(*sendmailAlerter); strings.Join(sa.To, " ") != "a@example.com b@example.com c@example.com" {
+		t.Errorf("sendmail: got %q", sa.To)
+	}
+	if sa := ma[1].(smtpAlerter); sa.Addr != "mail.example.com:25" || sa.Auth == nil || sa.To[0] != "d@example.com" {
+		t.Errorf("smtp: got %+v", sa)
+	}
+
+	ctx := context.Background()
+	fn := filepath.Join(t.TempDir(), "alerts.txt")
+	var got struct{ Title, Text string }
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+	if a, err = newAlerter([]string{"file://" + fn + "?subject=test", srv.URL}); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Alert(ctx, "auth failure", "boom"); err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != defaultAlertSubject+": auth failure" || !strings.Contains(got.Text, "boom") {
+		t.Errorf("webhook: got %+v", got)
+	}
+	if b, err := os.ReadFile(fn); err != nil {
+		t.Fatal(err)
+	} else if s := string(b); !strings.Contains(s, " test: auth failure\nboom\n") {
+		t.Errorf("file: got %q", s)
+	}
+}
+
+func TestSMTPAlerterHang(t *testing.T) {
+	// The server accepts the connection, but never greets.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	sa := smtpAlerter{Addr: ln.Addr().String(), From: "a@example.com", To: []string{"b@example.com"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err = sa.Alert(ctx, "test", "hang"); err == nil {
+		t.Fatal("wanted error")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("returned after %s", d)
+	}
+}
+
+type recordingAlerter struct{ subjects, bodies []string }
+
+func (ra *recordingAlerter) Alert(ctx context.Context, subject, body string) error {
+	ra.subjects, ra.bodies = append(ra.subjects, subject), append(ra.bodies, body)
+	return nil
+}
+
+func TestAlertNotifier(t *testing.T) {
+	for _, tc := range []struct {
+		Err  error
+		Want alertClass
+	}{
+		{fmt.Errorf("%w: empty response", errAuthenticate), alertAuth},
+		{&JIRAError{Code: "503 Service Unavailable"}, alertServer},
+		{&JIRAError{Code: "404 Not Found", Messages: []string{"Issue Does Not Exist"}}, alertNotFound},
+		{&JIRAError{Code: "403 Forbidden"}, alertPermission},
+		{&dirq.DeadLetterError{Err: errors.New("boom"), Name: "x"}, alertDeadLetter},
+		{errors.New("boom"), alertOther},
+	} {
+		if got := classifyAlert(tc.Err); got != tc.Want {
+			t.Errorf("%v: got %q, wanted %q", tc.Err, got, tc.Want)
+		}
+	}
+
+	ctx := context.Background()
+	var ra recordingAlerter
+	an := newAlertNotifier(&ra)
+	serverErr := &JIRAError{Code: "502 Bad Gateway"}
+	for _, id := range []string{"A-1", "A-2", "A-1"} {
+		if err := an.Record(ctx, "q", serverErr, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ra.subjects) != 1 || ra.subjects[0] != string(alertServer) || !strings.Contains(ra.bodies[0], "NEW "+string(alertServer)+" in q: 1 times") {
+		t.Fatalf("new: got %q %q", ra.subjects, ra.bodies)
+	}
+	now := time.Now()
+	if subject, _ := an.report(now); subject != "" {
+		t.Errorf("not due: got %q", subject)
+	}
+	subject, body := an.report(now.Add(an.EscalateAfter))
+	if subject != string(alertServer)+" persists" || !strings.Contains(body, "ESCALATED (level 1)") || !strings.Contains(body, "2 times") || !strings.Contains(body, "A-2, A-1") {
+		t.Errorf("escalated: got %q\n%s", subject, body)
+	}
+	// Quiet is not recovered: the queue may just wait with its retries.
+	if subject, _ = an.report(now.Add(an.EscalateAfter + 365*24*time.Hour)); subject != "" {
+		t.Errorf("quiet: got %q", subject)
+	}
+	an.Succeeded("other", "B-1")
+	if subject, _ = an.report(now); subject != "" {
+		t.Errorf("other queue succeeded: got %q", subject)
+	}
+	an.Succeeded("q", "B-1") // any issue recovers a server error
+	subject, body = an.report(now)
+	if subject != string(alertServer)+" recovered" || !strings.Contains(body, "RECOVERED") || !strings.Contains(body, "3 in total") {
+		t.Errorf("recovered: got %q\n%s", subject, body)
+	}
+	if len(an.active) != 0 {
+		t.Errorf("active: %v", an.active)
+	}
+
+	// The escalation delay does not overflow, but stops at MaxEscalateAfter.
+	if err := an.Record(ctx, "q", serverErr, "A-3"); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range an.active {
+		st.Level = 100
+	}
+	if err := an.Record(ctx, "q", serverErr, "A-3"); err != nil {
+		t.Fatal(err)
+	}
+	now = time.Now()
+	if subject, _ = an.report(now.Add(an.MaxEscalateAfter / 2)); subject != "" {
+		t.Errorf("level 100 before MaxEscalateAfter: got %q", subject)
+	}
+	if subject, _ = an.report(now.Add(an.MaxEscalateAfter)); subject != string(alertServer)+" persists" {
+		t.Errorf("level 100 after MaxEscalateAfter: got %q", subject)
+	}
+	an.Succeeded("q", "")
+	an.report(now) // recovered
+
+	// Issue A keeps failing, while issue B succeeds.
+	notFound := &JIRAError{Code: "404 Not Found", Messages: []string{"Issue Does Not Exist"}}
+	if err := an.Record(ctx, "q", notFound, "A-1"); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Now()
+	for i := 1; i <= 3; i++ {
+		an.Succeeded("q", "B-1")
+		if err := an.Record(ctx, "q", notFound, "A-1"); err != nil {
+			t.Fatal(err)
+		}
+		at = at.Add(an.EscalateAfter << (i - 1))
+		if subject, _ = an.report(at); subject != string(alertNotFound)+" persists" {
+			t.Errorf("%d. success of another issue: got %q", i, subject)
+		}
+	}
+	an.Succeeded("q", "A-1")
+	if subject, _ = an.report(at); subject != string(alertNotFound)+" recovered" {
+		t.Errorf("success of the issue: got %q", subject)
+	}
+}
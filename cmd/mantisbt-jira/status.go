@@ -0,0 +1,302 @@
+// Copyright 2025 Tamás Gulácsi. All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/mantisbt-plugins-Jira/cmd/mantisbt-jira/dirq"
+)
+
+// queueState is the processing state of a queue served by serve.
+type queueState struct {
+	lastSuccess, lastErrorTime time.Time
+	started                    time.Time
+	queue                      *dirq.Queue
+	baseURL                    string
+	lastError                  string
+	authBackoff                bool
+	mu                         sync.Mutex
+}
+
+// setQueue records the queue of the service, when it has been (re)started.
+func (qs *queueState) setQueue(svc *SVC) {
+	qs.mu.Lock()
+	qs.baseURL, qs.queue = svc.BaseURL, svc.queue
+	qs.started = time.Now()
+	qs.mu.Unlock()
+}
+
+// Observer returns the dirq.Observer recording the last success and error.
+func (qs *queueState) Observer() dirq.Observer {
+	return func(e dirq.Event) {
+		qs.mu.Lock()
+		defer qs.mu.Unlock()
+		switch e.Kind {
+		case dirq.EventSucceeded:
+			qs.lastSuccess = e.Time
+		case dirq.EventFailed, dirq.EventDeadLettered, dirq.EventQuarantined:
+			qs.lastErrorTime = e.Time
+			if e.Err != nil {
+				qs.lastError = e.Err.Error()
+			}
+		}
+	}
+}
+
+// setAuthBackoff records whether the queue waits with the authentication backoff strategy.
+func (qs *queueState) setAuthBackoff(b bool) {
+	qs.mu.Lock()
+	qs.authBackoff = b
+	qs.mu.Unlock()
+}
+
+// serveState is the set of the queues discovered by serve.
+//
+// The services are used only by serve, the states are shared with the status handler.
+type serveState struct {
+	services map[string]*SVC
+	states   map[string]*queueState
+	// restarts are the names of the queues to be restarted (see Restart).
+	restarts chan string
+	// events are the last lifecycle events of the queues.
+	events []queueEvent
+	ready  bool
+	mu     sync.Mutex
+}
+
+// queueEvent is a lifecycle event of a queue of serve:
+// added, reloaded (its config has changed), restarted or removed.
+type queueEvent struct {
+	Time  time.Time
+	Queue string
+	Event string
+	Error string `json:",omitempty"`
+}
+
+// maxQueueEvents is the number of the lifecycle events kept by serveState.
+const maxQueueEvents = 100
+
+var errUnknownQueue = errors.New("unknown queue")
+
+func newServeState() *serveState {
+	return &serveState{
+		services: make(map[string]*SVC), states: make(map[string]*queueState),
+		restarts: make(chan string, 16),
+	}
+}
+
+// Add the service of the queue, returning its state
+// (the state is kept when the service of the queue is replaced).
+func (ss *serveState) Add(name string, svc *SVC) *queueState {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.services[name] = svc
+	qs := ss.states[name]
+	if qs == nil {
+		qs = new(queueState)
+		ss.states[name] = qs
+	}
+	return qs
+}
+
+// Remove the queue.
+func (ss *serveState) Remove(name string) {
+	ss.mu.Lock()
+	delete(ss.services, name)
+	delete(ss.states, name)
+	ss.mu.Unlock()
+}
+
+// Event records a lifecycle event of the queue.
+func (ss *serveState) Event(name, event string, err error) {
+	e := queueEvent{Time: time.Now(), Queue: name, Event: event}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	ss.mu.Lock()
+	if len(ss.events) >= maxQueueEvents {
+		ss.events = slices.Delete(ss.events, 0, len(ss.events)-maxQueueEvents+1)
+	}
+	ss.events = append(ss.events, e)
+	ss.mu.Unlock()
+}
+
+// Events returns the last lifecycle events of the queues.
+func (ss *serveState) Events() []queueEvent {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return slices.Clone(ss.events)
+}
+
+// Restart requests the restart of the consumers of the queue.
+func (ss *serveState) Restart(name string) error {
+	ss.mu.Lock()
+	_, ok := ss.states[name]
+	ss.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%q: %w", name, errUnknownQueue)
+	}
+	select {
+	case ss.restarts <- name:
+		return nil
+	default:
+		return errors.New("too many pending restarts")
+	}
+}
+
+// SetReady marks the queues as discovered.
+func (ss *serveState) SetReady() {
+	ss.mu.Lock()
+	ss.ready = true
+	ss.mu.Unlock()
+}
+
+// queueStatus is the status of a queue, as reported by /status.
+type queueStatus struct {
+	// Started is the time the queue has been (re)started.
+	Started       time.Time
+	LastSuccess   time.Time
+	LastErrorTime time.Time
+	Name          string
+	BaseURL       string
+	// OldestAge is the age of the oldest pending item.
+	OldestAge string `json:",omitempty"`
+	LastError string `json:",omitempty"`
+	// Error is the error of reading the queue.
+	Error                                string `json:",omitempty"`
+	Pending, InFlight, Dead, Quarantined int
+	// AuthBackoff is true while the queue waits with the authentication backoff strategy.
+	AuthBackoff bool
+
+	// oldestDue is the time the oldest due item waits since (see dirq.Stats).
+	oldestDue time.Time
+}
+
+// Status returns the status of the queues, ordered by name.
+func (ss *serveState) Status() []queueStatus {
+	ss.mu.Lock()
+	names := make([]string, 0, len(ss.states))
+	for nm := range ss.states {
+		names = append(names, nm)
+	}
+	slices.Sort(names)
+	states := make([]*queueState, len(names))
+	for i, nm := range names {
+		states[i] = ss.states[nm]
+	}
+	ss.mu.Unlock()
+
+	now := time.Now()
+	statuses := make([]queueStatus, 0, len(names))
+	for i, nm := range names {
+		qs := states[i]
+		st := queueStatus{Name: nm}
+		qs.mu.Lock()
+		Q := qs.queue
+		st.BaseURL, st.AuthBackoff, st.Started = qs.baseURL, qs.authBackoff, qs.started
+		st.LastSuccess, st.LastErrorTime, st.LastError = qs.lastSuccess, qs.lastErrorTime, qs.lastError
+		qs.mu.Unlock()
+		if Q == nil {
+			st.Error = "no queue (unreadable config)"
+		} else if qst, err := Q.Stats(); err != nil {
+			st.Error = err.Error()
+		} else {
+			st.Pending, st.InFlight = qst.Count-qst.InFlight, qst.InFlight
+			st.Dead, st.Quarantined = qst.Dead, qst.Quarantined
+			st.oldestDue = qst.OldestDue
+			if !qst.Oldest.IsZero() {
+				st.OldestAge = now.Sub(qst.Oldest).Truncate(time.Second).String()
+			}
+		}
+		statuses = append(statuses, st)
+	}
+	return statuses
+}
+
+// Handler returns the handler of the health and status endpoints:
+// /healthz (the process is alive), /readyz (the queues have been discovered),
+// /status (the status and the lifecycle events of the queues, as JSON),
+// /metrics (in the Prometheus text format), /debug/vars (the expvar metrics),
+// and POST /queues/{name}/restart (restart the consumers of the queue).
+func (ss *serveState) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		ss.mu.Lock()
+		ready := ss.ready
+		ss.mu.Unlock()
+		if !ready {
+			http.Error(w, "queues are not discovered yet", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			Queues []queueStatus
+			Events []queueEvent
+		}{Queues: ss.Status(), Events: ss.Events()}); err != nil {
+			logger.Error("encode status", "error", err)
+		}
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		bw := bufio.NewWriter(w)
+		writeMetrics(bw, ss)
+		if err := bw.Flush(); err != nil {
+			logger.Error("write metrics", "error", err)
+		}
+	})
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("POST /queues/{name}/restart", func(w http.ResponseWriter, r *http.Request) {
+		if err := ss.Restart(r.PathValue("name")); err != nil {
+			code := http.StatusServiceUnavailable
+			if errors.Is(err, errUnknownQueue) {
+				code = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), code)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("restarting\n"))
+	})
+	return mux
+}
+
+// listenStatus serves the health and status endpoints on addr, till ctx is done.
+func listenStatus(ctx context.Context, addr string, ss *serveState) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: ss.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutCtx)
+	}()
+	go func() {
+		logger.Info("status listener", "addr", ln.Addr().String())
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("status listener", "addr", addr, "error", err)
+		}
+	}()
+	return nil
+}
@@ -54,6 +54,18 @@ print_manage_menu( 'manage_plugin_page.php' );
 	</td>
 </tr>
 <?php } ?>
+<?php
+	foreach( array( 'queue_max_items', 'queue_max_bytes' ) as $k ) {
+?>
+<tr>
+	<th class="category width-40">
+		<?php echo plugin_lang_get( $k )?>
+	</th>
+	<td class="center" width="20%">
+		<input type="number" min="0" class="ace" name="<?php echo $k; ?>" value="<?php echo (int)plugin_config_get( $k, 0 ); ?>" />
+	</td>
+</tr>
+<?php } ?>
 
 </table>
 </div>
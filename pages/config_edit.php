@@ -27,6 +27,15 @@ foreach( array( 'base', 'user', 'password' ) as $k ) {
 	}
 }
 
+# The limits of the queue (0: no limit).
+foreach( array( 'queue_max_items', 'queue_max_bytes' ) as $k ) {
+	$t_old = (int)plugin_config_get( $k, 0 );
+	$f_new = max( 0, gpc_get_int( $k, 0 ) );
+	if( $t_old != $f_new ) {
+		plugin_config_set( $k, $f_new );
+	}
+}
+
 form_security_purge( 'plugin_jira_config_edit' );
 
 print_successful_redirect( plugin_page( 'config', true ) );